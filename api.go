@@ -0,0 +1,404 @@
+package opbot
+
+/*
+HTTP admin API, for managing the OPs list without being on IRC. Changes go
+through the same path as the IRC commands: they're journaled (so "!op undo"
+works on them), written to the audit log, saved to the OPs file, and present
+users get OP or are DEOPed right away.
+
+All requests need the header "Authorization: Bearer <token>". Channel names,
+nicks and hostmasks in the path must be URL encoded, e.g. %23channel for
+#channel. A channel name without # or & gets # added. Channels in a network
+namespace are given by their key, like libera%2F%23channel for libera/#channel.
+
+	GET    /api/channels                             List channel names
+	GET    /api/channels/<channel>                   Get channel, as saved in the OPs file
+	GET    /api/channels/<channel>/users             List OPs
+	GET    /api/channels/<channel>/users/<nick>      Get OP
+	PUT    /api/channels/<channel>/users/<nick>      Add OP, or replace hostmasks. Body: {"hostmasks": ["nick!user@host"]}
+	DELETE /api/channels/<channel>/users/<nick>      Remove OP
+	GET    /api/channels/<channel>/users/<nick>/masks           List hostmasks
+	POST   /api/channels/<channel>/users/<nick>/masks           Add hostmask. Body: {"hostmask": "nick!user@host"}
+	DELETE /api/channels/<channel>/users/<nick>/masks/<mask>    Remove hostmask
+	GET    /api/channels/<channel>/wmsg              Get welcome message
+	PUT    /api/channels/<channel>/wmsg              Set welcome message. Body: {"wmsg": "Welcome, {{.Nick}}"}
+	DELETE /api/channels/<channel>/wmsg              Remove welcome message
+
+Responses are JSON, errors as {"error": "..."}.
+*/
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	API_PREFIX string = "/api/"
+)
+
+type apiUser struct {
+	Nick      string     `json:"nick"`
+	Hostmasks []string   `json:"hostmasks"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Schedule  []*Window  `json:"schedule,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiRequest is what a handler needs to know about the request
+type apiRequest struct {
+	r       *http.Request
+	channel string
+	nick    string
+	mask    string
+	by      origin
+}
+
+// APIHandler returns the handler for the admin API, to be served under API_PREFIX.
+// Every request must carry token as a bearer token. An empty token denies everything.
+func APIHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const fn string = "APIHandler()"
+
+		auth := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			log.Warnf("%s: Unauthorized API request from %s", PLUGIN, r.RemoteAddr)
+			apiReply(w, http.StatusUnauthorized, apiError{"Unauthorized"})
+			return
+		}
+
+		parts, err := apiPath(r.URL)
+		if err != nil {
+			apiReply(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		devdbg("%s: %s: %s %q", PLUGIN, fn, r.Method, parts)
+
+		if len(parts) == 0 || parts[0] != "channels" {
+			apiReply(w, http.StatusNotFound, apiError{"Not found"})
+			return
+		}
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet {
+				apiReply(w, http.StatusMethodNotAllowed, apiError{"Method not allowed"})
+				return
+			}
+			apiReply(w, http.StatusOK, ops().ChannelNames())
+			return
+		}
+
+		ar := &apiRequest{
+			r:       r,
+			channel: parts[1],
+			by: origin{
+				Caller:  apiCaller(r),
+				Command: fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+			},
+		}
+		if ns, name := SplitKey(ar.channel); !isChannel(name) {
+			ar.channel = Key(ns, "#"+name)
+		}
+		if len(parts) > 3 {
+			ar.nick = parts[3]
+			if !ValidNick(ar.nick) {
+				apiReply(w, http.StatusBadRequest, apiError{fmt.Sprintf("%q is not a valid nick", ar.nick)})
+				return
+			}
+		}
+		if len(parts) > 5 {
+			ar.mask = parts[5]
+		}
+
+		var status int
+		var res interface{}
+		switch {
+		case len(parts) == 2:
+			status, res = apiChannel(ar)
+		case len(parts) == 3 && parts[2] == "wmsg":
+			status, res = apiWmsg(ar)
+		case len(parts) == 3 && parts[2] == "users":
+			status, res = apiUsers(ar)
+		case len(parts) == 4 && parts[2] == "users":
+			status, res = apiUserHandler(ar)
+		case len(parts) >= 5 && len(parts) <= 6 && parts[2] == "users" && parts[4] == "masks":
+			status, res = apiMasks(ar)
+		default:
+			status, res = http.StatusNotFound, apiError{"Not found"}
+		}
+
+		if r.Method != http.MethodGet {
+			a := &AuditEntry{
+				Time:    time.Now(),
+				Channel: ar.channel,
+				Caller:  ar.by.Caller,
+				Command: "http " + strings.ToLower(r.Method),
+				Args:    []string{r.URL.Path},
+				Result:  http.StatusText(status),
+			}
+			if e, ok := res.(apiError); ok {
+				a.Error = e.Error
+			}
+			audit(a)
+		}
+		apiReply(w, status, res)
+	})
+}
+
+// apiPath splits the path after API_PREFIX into unescaped parts
+func apiPath(u *url.URL) ([]string, error) {
+	p := strings.Trim(strings.TrimPrefix(u.EscapedPath(), API_PREFIX), "/")
+	if p == "" {
+		return nil, nil
+	}
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		up, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = up
+	}
+	return parts, nil
+}
+
+// apiCaller makes something that looks like a hostmask for the journal and audit log
+func apiCaller(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "http!api@" + host
+}
+
+func apiReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+// apiBody decodes the JSON request body into v
+func apiBody(ar *apiRequest, v interface{}) error {
+	defer ar.r.Body.Close()
+	dec := json.NewDecoder(ar.r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("Invalid request body: %s", err.Error())
+	}
+	return nil
+}
+
+// apiLookup returns the channel without creating it, like _ops.Get would
+func apiLookup(channel string) (*Channel, bool) {
+	_changeMu.Lock()
+	reloadIfChanged()
+	_changeMu.Unlock()
+	ops := ops()
+	ops.RLock()
+	defer ops.RUnlock()
+	c, found := ops.Channels[channel]
+	return c, found
+}
+
+func apiUserView(c *Channel, nick string) apiUser {
+	u := apiUser{
+		Nick:      nick,
+		Hostmasks: c.Hostmasks(nick),
+		Schedule:  c.Schedule(nick),
+	}
+	if u.Hostmasks == nil {
+		u.Hostmasks = []string{}
+	}
+	if t, found := c.Expiry(nick); found {
+		u.Expires = &t
+	}
+	return u
+}
+
+// apiChange runs fn through change(), so it's journaled and saved, and syncs modes for nicks
+func apiChange(ar *apiRequest, nicks []string, fn func(c *Channel)) error {
+	_, err := change(ar.channel, ar.by, fn)
+	if err != nil {
+		return err
+	}
+	syncModes(ar.channel, nicks)
+	return nil
+}
+
+func apiChannel(ar *apiRequest) (int, interface{}) {
+	if ar.r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, apiError{"Method not allowed"}
+	}
+	c, found := apiLookup(ar.channel)
+	if !found {
+		return http.StatusNotFound, apiError{fmt.Sprintf("No such channel: %s", ar.channel)}
+	}
+	c.RLock()
+	defer c.RUnlock()
+	jb, err := json.Marshal(c)
+	if err != nil {
+		return http.StatusInternalServerError, apiError{err.Error()}
+	}
+	return http.StatusOK, json.RawMessage(jb)
+}
+
+func apiWmsg(ar *apiRequest) (int, interface{}) {
+	type body struct {
+		Wmsg string `json:"wmsg"`
+	}
+
+	switch ar.r.Method {
+	case http.MethodGet:
+		c, found := apiLookup(ar.channel)
+		if !found {
+			return http.StatusNotFound, apiError{fmt.Sprintf("No such channel: %s", ar.channel)}
+		}
+		c.RLock()
+		defer c.RUnlock()
+		return http.StatusOK, body{c.WelcomeMsg}
+	case http.MethodPut, http.MethodDelete:
+		b := body{}
+		if ar.r.Method == http.MethodPut {
+			if err := apiBody(ar, &b); err != nil {
+				return http.StatusBadRequest, apiError{err.Error()}
+			}
+			if err := ValidateWMsg(b.Wmsg); err != nil {
+				return http.StatusBadRequest, apiError{fmt.Sprintf("Invalid welcome message: %s", err.Error())}
+			}
+		}
+		err := apiChange(ar, nil, func(c *Channel) {
+			c.Lock()
+			c.WelcomeMsg = b.Wmsg
+			c.Unlock()
+		})
+		if err != nil {
+			return http.StatusInternalServerError, apiError{err.Error()}
+		}
+		return http.StatusOK, b
+	}
+	return http.StatusMethodNotAllowed, apiError{"Method not allowed"}
+}
+
+func apiUsers(ar *apiRequest) (int, interface{}) {
+	if ar.r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, apiError{"Method not allowed"}
+	}
+	c, found := apiLookup(ar.channel)
+	if !found {
+		return http.StatusNotFound, apiError{fmt.Sprintf("No such channel: %s", ar.channel)}
+	}
+	users := make([]apiUser, 0)
+	for _, nick := range c.Nicks() {
+		users = append(users, apiUserView(c, nick))
+	}
+	return http.StatusOK, users
+}
+
+func apiUserHandler(ar *apiRequest) (int, interface{}) {
+	switch ar.r.Method {
+	case http.MethodGet:
+		c, found := apiLookup(ar.channel)
+		if !found || !c.Has(ar.nick) {
+			return http.StatusNotFound, apiError{fmt.Sprintf("%q is not in the OPs list for %s", ar.nick, ar.channel)}
+		}
+		return http.StatusOK, apiUserView(c, ar.nick)
+
+	case http.MethodPut:
+		b := struct {
+			Hostmasks []string `json:"hostmasks"`
+		}{}
+		if err := apiBody(ar, &b); err != nil {
+			return http.StatusBadRequest, apiError{err.Error()}
+		}
+		if len(b.Hostmasks) == 0 {
+			return http.StatusBadRequest, apiError{"At least one hostmask is needed"}
+		}
+		for _, m := range b.Hostmasks {
+			if !ValidMask(m) {
+				return http.StatusBadRequest, apiError{fmt.Sprintf("Invalid hostmask %q, expected nick!user@host", m)}
+			}
+		}
+		err := apiChange(ar, []string{ar.nick}, func(c *Channel) {
+			c.ClearHostmasks(ar.nick)
+			for _, m := range b.Hostmasks {
+				c.Add(ar.nick, m)
+			}
+		})
+		if err != nil {
+			return http.StatusInternalServerError, apiError{err.Error()}
+		}
+		return http.StatusOK, apiUserView(ops().Get(ar.channel), ar.nick)
+
+	case http.MethodDelete:
+		c, found := apiLookup(ar.channel)
+		if !found || !c.Has(ar.nick) {
+			return http.StatusNotFound, apiError{fmt.Sprintf("%q is not in the OPs list for %s", ar.nick, ar.channel)}
+		}
+		err := apiChange(ar, []string{ar.nick}, func(c *Channel) {
+			c.Remove(ar.nick)
+		})
+		if err != nil {
+			return http.StatusInternalServerError, apiError{err.Error()}
+		}
+		return http.StatusOK, struct {
+			Removed string `json:"removed"`
+		}{ar.nick}
+	}
+	return http.StatusMethodNotAllowed, apiError{"Method not allowed"}
+}
+
+func apiMasks(ar *apiRequest) (int, interface{}) {
+	c, found := apiLookup(ar.channel)
+	if !found || !c.Has(ar.nick) {
+		return http.StatusNotFound, apiError{fmt.Sprintf("%q is not in the OPs list for %s", ar.nick, ar.channel)}
+	}
+
+	switch {
+	case ar.r.Method == http.MethodGet && ar.mask == "":
+		return http.StatusOK, apiUserView(c, ar.nick).Hostmasks
+
+	case ar.r.Method == http.MethodPost && ar.mask == "":
+		b := struct {
+			Hostmask string `json:"hostmask"`
+		}{}
+		if err := apiBody(ar, &b); err != nil {
+			return http.StatusBadRequest, apiError{err.Error()}
+		}
+		if !ValidMask(b.Hostmask) {
+			return http.StatusBadRequest, apiError{fmt.Sprintf("Invalid hostmask %q, expected nick!user@host", b.Hostmask)}
+		}
+		err := apiChange(ar, []string{ar.nick}, func(c *Channel) {
+			c.Add(ar.nick, b.Hostmask)
+		})
+		if err != nil {
+			return http.StatusInternalServerError, apiError{err.Error()}
+		}
+		return http.StatusOK, apiUserView(ops().Get(ar.channel), ar.nick).Hostmasks
+
+	case ar.r.Method == http.MethodDelete && ar.mask != "":
+		removed := false
+		err := apiChange(ar, []string{ar.nick}, func(c *Channel) {
+			removed = c.RemoveHostmask(ar.nick, ar.mask)
+		})
+		if err != nil {
+			return http.StatusInternalServerError, apiError{err.Error()}
+		}
+		if !removed {
+			return http.StatusNotFound, apiError{fmt.Sprintf("No hostmask %q for %q in %s", ar.mask, ar.nick, ar.channel)}
+		}
+		return http.StatusOK, apiUserView(ops().Get(ar.channel), ar.nick).Hostmasks
+	}
+	return http.StatusMethodNotAllowed, apiError{"Method not allowed"}
+}
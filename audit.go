@@ -0,0 +1,194 @@
+package opbot
+
+/*
+The audit log is an append-only file with one JSON object per line, recording
+who ran which command changing the OPs list or channel settings, and what came
+of it. It's kept separate from the OPs file, so it survives "!op clear".
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEF_AUDITFILE string = "/tmp/opbot_audit.json"
+)
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Network string    `json:"network,omitempty"` // where the command came from, as channels may be shared
+	Caller  string    `json:"caller"`            // nick!user@host
+	Command string    `json:"command"`
+	Args    []string  `json:"args,omitempty"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	_auditfile = DEF_AUDITFILE
+	_auditLock sync.Mutex
+)
+
+// SetAuditFile sets where to log mutating commands. An empty filename disables the audit log.
+// Call it before InitBot.
+func SetAuditFile(filename string) {
+	_auditfile = filename
+}
+
+func (a *AuditEntry) String() string {
+	s := fmt.Sprintf(
+		"%s %s %s: %s",
+		a.Time.Format("2006-01-02 15:04"),
+		a.Channel,
+		a.Caller,
+		strings.TrimSpace(a.Command+" "+strings.Join(a.Args, " ")),
+	)
+	if a.Result != "" {
+		s += " => " + strings.TrimPrefix(a.Result, PLUGIN+": ")
+	}
+	if a.Error != "" {
+		s += " (error: " + a.Error + ")"
+	}
+	return s
+}
+
+// auditLater logs the outcome of a command that had to wait for a WHOIS reply,
+// following the "pending" entry logged when it was run
+func (n *Network) auditLater(channel string, by origin, result string, err error) {
+	a := &AuditEntry{
+		Time:    time.Now(),
+		Channel: n.key(channel),
+		Network: n.Name,
+		Caller:  by.Caller,
+		Result:  result,
+	}
+	if fields := strings.Fields(by.Command); len(fields) > 0 {
+		a.Command, a.Args = strings.ToLower(fields[0]), fields[1:]
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	audit(a)
+}
+
+// audit appends an entry to the audit log, if enabled
+func audit(a *AuditEntry) {
+	if _auditfile == "" {
+		return
+	}
+	_auditLock.Lock()
+	defer _auditLock.Unlock()
+
+	file, err := os.OpenFile(_auditfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("%s: Unable to open audit log: %s", PLUGIN, err.Error())
+		return
+	}
+	defer file.Close()
+
+	jb, err := json.Marshal(a)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_, err = file.Write(append(jb, '\n'))
+	if err != nil {
+		log.Errorf("%s: Unable to write to audit log: %s", PLUGIN, err.Error())
+	}
+}
+
+// ReadAudit reads all entries from r, skipping any lines that can't be parsed
+func ReadAudit(r io.Reader) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		a := &AuditEntry{}
+		if err := json.Unmarshal(line, a); err != nil {
+			log.Warnf("%s: Skipping invalid audit log line: %s", PLUGIN, err.Error())
+			continue
+		}
+		entries = append(entries, a)
+	}
+	return entries, scanner.Err()
+}
+
+// ReadAuditFile reads the audit log from filename. A file that doesn't exist yet, as
+// nothing has been changed since the audit log was turned on, is an empty log.
+func ReadAuditFile(filename string) ([]*AuditEntry, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return []*AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadAudit(file)
+}
+
+// FilterAudit returns the last n entries matching channel and nick, where empty
+// values match anything. If n <= 0, all matching entries are returned.
+func FilterAudit(entries []*AuditEntry, channel, nick string, n int) []*AuditEntry {
+	res := make([]*AuditEntry, 0)
+	for _, a := range entries {
+		if channel != "" && !strings.EqualFold(a.Channel, channel) {
+			continue
+		}
+		if nick != "" && !strings.EqualFold(strings.SplitN(a.Caller, "!", 2)[0], nick) {
+			continue
+		}
+		res = append(res, a)
+	}
+	if n > 0 && len(res) > n {
+		res = res[len(res)-n:]
+	}
+	return res
+}
+
+// auditLog gives the last n entries for channel, for showing in the channel
+func auditLog(channel, num string) (string, error) {
+	const max int = 10 // don't flood the channel
+
+	n := 5
+	if num != "" {
+		if _, err := fmt.Sscanf(num, "%d", &n); err != nil || n <= 0 {
+			return fmt.Sprintf("%s: Usage: !op %s [number of entries, max %d]", PLUGIN, strings.ToLower(LOG), max), nil
+		}
+	}
+	if n > max {
+		n = max
+	}
+	if _auditfile == "" {
+		return PLUGIN + ": Audit log is disabled", nil
+	}
+
+	entries, err := ReadAuditFile(_auditfile)
+	if err != nil {
+		log.Error(err)
+		return PLUGIN + ": Unable to read audit log", err
+	}
+	entries = FilterAudit(entries, channel, "", n)
+	if len(entries) == 0 {
+		return fmt.Sprintf("%s: No audit log entries for %s", PLUGIN, channel), nil
+	}
+	lines := make([]string, 0, len(entries))
+	for _, a := range entries {
+		lines = append(lines, a.String())
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,208 @@
+package opbot
+
+/*
+Kick-bans. "!op kb <nick> [duration] [reason]" makes a ban mask from the nick's
+current hostmask and the channel's ban mask template, sets the ban, and kicks
+the nick. The hostmask is taken from the roster, or looked up with WHOIS if the
+nick hasn't been seen in the channel.
+
+A template is a mask where these words are replaced, when they're the whole
+part of the mask, so that a literal mask like "*!*@localhost" is left alone:
+
+- "nick" as the nick part, with the nick
+- "ident" as the user part, with the user name, as the server shows it
+- "host" as the host part, with the host
+- "domain" or "*.domain" as the host part, with the host minus its first part,
+  like "example.com" for "dsl-1.example.com". For IP addresses and hosts with
+  less than three parts, "*.domain" and "domain" are both just the host.
+
+So "*!*@host" (the default) bans everyone from the host, and "*!ident@*.domain"
+the user name from anywhere in the domain.
+
+Bans with a duration are kept in the OPs file along with flood measures, and
+lifted by the scheduler when the time is up, even if the bot has restarted.
+*/
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEF_BAN_MASK string = "*!*@host"
+)
+
+// BanMask makes a ban mask for hostmask (nick!user@host) from template
+func BanMask(template, hostmask string) string {
+	tbang := strings.Index(template, "!")
+	tat := strings.LastIndex(template, "@")
+	bang := strings.Index(hostmask, "!")
+	at := strings.LastIndex(hostmask, "@")
+	if tbang < 0 || tat < tbang || bang < 0 || at < bang {
+		return template
+	}
+	nick, ident, host := hostmask[:bang], hostmask[bang+1:at], hostmask[at+1:]
+	tnick, tident, thost := template[:tbang], template[tbang+1:tat], template[tat+1:]
+
+	if tnick == "nick" {
+		tnick = nick
+	}
+	if tident == "ident" {
+		tident = ident
+	}
+	switch thost {
+	case "host":
+		thost = host
+	case "domain", "*.domain":
+		if domain := domainOf(host); domain != "" {
+			thost = strings.Replace(thost, "domain", domain, 1)
+		} else {
+			thost = host
+		}
+	}
+	return tnick + "!" + tident + "@" + thost
+}
+
+// domainOf gives host minus its first part, or "" for IP addresses and hosts with less than three parts
+func domainOf(host string) string {
+	if net.ParseIP(host) != nil || strings.Count(host, ".") < 2 {
+		return ""
+	}
+	return host[strings.Index(host, ".")+1:]
+}
+
+// ValidBanMask tells if template can be used to make ban masks
+func ValidBanMask(template string) bool {
+	return ValidMask(template)
+}
+
+// banMaskTemplate gives the ban mask template for channel, from the OPs file or the policy
+func banMaskTemplate(channel string, c *Channel) string {
+	c.RLock()
+	tmpl := c.BanMask
+	c.RUnlock()
+	if tmpl != "" {
+		return tmpl
+	}
+	if tmpl = policy(channel).BanMask; tmpl != "" {
+		return tmpl
+	}
+	return DEF_BAN_MASK
+}
+
+// removeTimedMode drops a timed mode, so it's never lifted. Caller must hold the lock.
+func (c *Channel) removeTimedMode(mode, param, network string) {
+	keep := make([]*TimedMode, 0, len(c.Lifts))
+	for _, tm := range c.Lifts {
+		if tm.Mode != mode || tm.Param != param || tm.Network != network {
+			keep = append(keep, tm)
+		}
+	}
+	if len(keep) == 0 {
+		keep = nil
+	}
+	c.Lifts = keep
+}
+
+// kb kick-bans nick from channel, looking up the nick's hostmask first if we don't have it.
+// args are the optional duration and reason.
+func (n *Network) kb(channel string, by origin, caller, nick string, args []string) (string, error) {
+	if nick == "" {
+		return fmt.Sprintf("%s: Usage: !op %s <nick> [duration] [reason]", PLUGIN, strings.ToLower(KB)), nil
+	}
+	var ttl time.Duration
+	if len(args) > 0 {
+		if d, err := parseDuration(args[0]); err == nil && d > 0 {
+			ttl = d
+			args = args[1:]
+		}
+	}
+	reason := strings.Join(args, " ")
+	if reason == "" {
+		reason = "Banned by " + caller
+	}
+
+	return n.withHostmask(channel, by, nick, "banning", func(hostmask string) (string, error) {
+		return n.kickBan(channel, by, nick, hostmask, ttl, reason)
+	})
+}
+
+// withHostmask calls do with the hostmask of nick, from the roster if the nick is in channel,
+// or else from a WHOIS. In that case, the reply from do is sent to channel and audited when the
+// WHOIS reply comes, and what is what we were doing, for the error if there's no such nick.
+func (n *Network) withHostmask(channel string, by origin, nick, what string, do func(hostmask string) (string, error)) (string, error) {
+	const fn string = "withHostmask()"
+
+	if m := n.roster.Get(channel, nick); m != nil && ValidMask(m.Mask) {
+		return do(m.Mask)
+	}
+
+	go func() {
+		devdbg("%s: %s: Goroutine waiting to read from n.wchan...", PLUGIN, fn)
+		hm := n.readWhois(_wcTimeout)
+		if hm == nil {
+			msg := fmt.Sprintf("%s: Error %s %q - no such nick", PLUGIN, what, nick)
+			n.Privmsg(channel, msg)
+			n.auditLater(channel, by, msg, nil)
+			return
+		}
+		msg, err := do(hm.String())
+		n.Privmsg(channel, msg)
+		n.auditLater(channel, by, msg, err)
+	}()
+
+	devdbg("%s: %s: Calling WHOIS on nick %q", PLUGIN, fn, nick)
+	n.whois(nick)
+	return "", _errPending
+}
+
+// kickBan bans the mask made from hostmask in channel, and kicks nick. If ttl > 0, the ban is lifted after that.
+func (n *Network) kickBan(channel string, by origin, nick, hostmask string, ttl time.Duration, reason string) (string, error) {
+	c := n.channel(channel)
+	if c.MatchHostMask(nick, hostmask) {
+		return fmt.Sprintf("%s: %q is in the OPs list, remove them first", PLUGIN, nick), nil
+	}
+	mask := BanMask(banMaskTemplate(n.key(channel), c), hostmask)
+	log.Infof("%s: %s: Banning %s (%s) in %s: %s", PLUGIN, n.Name, mask, nick, channel, reason)
+
+	n.mode(channel, "+b", mask)
+	n.kick(nick, channel, reason)
+
+	err := changeLifts(n.key(channel), func(c *Channel) {
+		c.Lock()
+		if ttl > 0 {
+			c.addTimedMode(&TimedMode{Mode: "+b", Param: mask, Until: time.Now().Add(ttl), Network: n.Name})
+		} else {
+			c.removeTimedMode("+b", mask, n.Name) // in case it was timed before
+		}
+		c.Unlock()
+	})
+	if ttl > 0 {
+		return fmt.Sprintf("%s: Banned %s from %s for %s", PLUGIN, mask, channel, fmtDuration(ttl)), err
+	}
+	return fmt.Sprintf("%s: Banned %s from %s", PLUGIN, mask, channel), err
+}
+
+// banMask shows or sets the ban mask template for channel
+func (n *Network) banMask(channel string, by origin, action, template string) (string, error) {
+	var err error
+	c := n.channel(channel)
+
+	if match(action, SET) {
+		if !ValidBanMask(template) {
+			return fmt.Sprintf("%s: Usage: !op %s %s <template>, like *!*@host or *!ident@*.domain", PLUGIN, strings.ToLower(BANMASK), strings.ToLower(SET)), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.BanMask = template
+			c.Unlock()
+		})
+	} else if action != "" && !match(action, GET) {
+		return fmt.Sprintf("%s: Usage: !op %s <get|set> [template]", PLUGIN, strings.ToLower(BANMASK)), nil
+	}
+	return fmt.Sprintf("%s: Ban mask template for %s: %s", PLUGIN, channel, banMaskTemplate(n.key(channel), c)), err
+}
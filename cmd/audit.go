@@ -0,0 +1,61 @@
+//go:build !make
+// +build !make
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/oddlid/opbot"
+	"github.com/urfave/cli"
+)
+
+// auditLog prints entries from the audit log, optionally filtered by channel and/or nick
+func auditLog(ctx *cli.Context) error {
+	entries, err := opbot.ReadAuditFile(ctx.GlobalString("auditfile"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_READ_AUDIT)
+	}
+	entries = opbot.FilterAudit(entries, ctx.String("channel"), ctx.String("nick"), ctx.Int("limit"))
+
+	for _, a := range entries {
+		if ctx.Bool("json") {
+			jb, err := json.Marshal(a)
+			if err != nil {
+				return cli.NewExitError(err.Error(), E_READ_AUDIT)
+			}
+			fmt.Fprintln(os.Stdout, string(jb))
+			continue
+		}
+		fmt.Fprintln(os.Stdout, a.String())
+	}
+	return nil
+}
+
+func auditCommand() cli.Command {
+	return cli.Command{
+		Name:   "log",
+		Usage:  "Show entries from the audit log",
+		Action: auditLog,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "channel, c",
+				Usage: "Only show entries for `channel`",
+			},
+			cli.StringFlag{
+				Name:  "nick, n",
+				Usage: "Only show entries for commands run by `nick`",
+			},
+			cli.IntFlag{
+				Name:  "limit",
+				Usage: "Show only the last `num` matching entries, 0 for all",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "Output entries as JSON lines, as stored in the log",
+			},
+		},
+	}
+}
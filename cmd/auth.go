@@ -0,0 +1,192 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+TLS and SASL setup for the IRC connection.
+
+go-ircevent only does SASL PLAIN itself, but it holds registration open until
+the login succeeds or fails. For EXTERNAL (log in with the client certificate,
+a.k.a. CertFP) we let it start PLAIN, and swap its AUTHENTICATE handler for our
+own, which aborts PLAIN when the server asks for credentials and starts EXTERNAL
+instead. go-ircevent adds its handlers on each connect, just before CAP LS, so
+we swap them when the server answers that. This needs a server that offers PLAIN
+too, which all the usual services do.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/oddlid/opbot"
+	log "github.com/sirupsen/logrus"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+const (
+	SASL_PLAIN    string = "PLAIN"
+	SASL_EXTERNAL string = "EXTERNAL"
+)
+
+// saslStep is how far an EXTERNAL login has come
+type saslStep int
+
+const (
+	SASL_STEP_PLAIN    saslStep = iota // go-ircevent has started PLAIN
+	SASL_STEP_ABORT                    // we've aborted PLAIN
+	SASL_STEP_EXTERNAL                 // we've started EXTERNAL
+)
+
+// checkSASL returns what's wrong with the given SASL settings, if anything
+func checkSASL(mech, login, password string, useTLS bool, certFile string) error {
+	switch strings.ToUpper(mech) {
+	case "":
+		if login != "" {
+			return fmt.Errorf("login given, but no mechanism")
+		}
+	case SASL_PLAIN:
+		if login == "" || password == "" {
+			return fmt.Errorf("PLAIN needs login and password")
+		}
+		if !useTLS {
+			return fmt.Errorf("PLAIN without TLS sends the password in clear text")
+		}
+	case SASL_EXTERNAL:
+		if !useTLS || certFile == "" {
+			return fmt.Errorf("EXTERNAL needs TLS and a client certificate")
+		}
+	default:
+		return fmt.Errorf("unsupported mechanism %q", mech)
+	}
+	return nil
+}
+
+// tlsConfig adjusts the TLS settings of a connection
+func tlsConfig(t TLSConfig, tc *tls.Config) (*tls.Config, error) {
+	if tc == nil {
+		tc = &tls.Config{}
+	}
+	if t.ServerName != "" {
+		tc.ServerName = t.ServerName
+	}
+	if t.InsecureSkipVerify {
+		log.Warnf("%s: Not verifying the TLS certificate of the server", opbot.PLUGIN)
+		tc.InsecureSkipVerify = true
+	}
+
+	if caFile := t.CAFile; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: No certificates found", caFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if certFile := t.CertFile; certFile != "" {
+		keyFile := t.KeyFile
+		if keyFile == "" {
+			keyFile = certFile // key in the same PEM file
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", certFile, err.Error())
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	} else if t.KeyFile != "" {
+		return nil, fmt.Errorf("TLS key given without certificate")
+	}
+	return tc, nil
+}
+
+// setupSASL sets up SASL authentication on a connection
+func setupSASL(settings IRCConfig, ic *ircevent.Connection) error {
+	sasl := settings.SASL
+	mech := strings.ToUpper(sasl.Mechanism)
+	err := checkSASL(mech, sasl.Login, sasl.Password, settings.TLS.Enabled, settings.TLS.CertFile)
+	if err != nil {
+		return fmt.Errorf("SASL: %s", err.Error())
+	}
+
+	switch mech {
+	case SASL_PLAIN:
+		ic.UseSASL = true
+		ic.SASLMech = mech
+		ic.SASLLogin = sasl.Login
+		ic.SASLPassword = sasl.Password
+	case SASL_EXTERNAL:
+		saslExternal(ic, sasl.Login)
+	}
+	return nil
+}
+
+// externalAuth answers the server during an EXTERNAL login, see the top of this file
+type externalAuth struct {
+	sync.Mutex
+	step    saslStep
+	authzid string // account to log in as, "" for the one the certificate belongs to
+	send    func(line string)
+}
+
+// onAuthenticate answers AUTHENTICATE +, which the server sends when it wants credentials
+func (ea *externalAuth) onAuthenticate(e *ircevent.Event) {
+	if len(e.Arguments) == 0 || e.Arguments[0] != "+" {
+		return
+	}
+	ea.Lock()
+	defer ea.Unlock()
+	switch ea.step {
+	case SASL_STEP_PLAIN:
+		ea.step = SASL_STEP_ABORT
+		ea.send("AUTHENTICATE *")
+	case SASL_STEP_EXTERNAL:
+		if ea.authzid == "" {
+			ea.send("AUTHENTICATE +")
+		} else {
+			ea.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(ea.authzid)))
+		}
+	}
+}
+
+// on906 starts EXTERNAL once the server has aborted PLAIN
+func (ea *externalAuth) on906(e *ircevent.Event) {
+	ea.Lock()
+	defer ea.Unlock()
+	if ea.step != SASL_STEP_ABORT {
+		log.Errorf("%s: SASL EXTERNAL login aborted by the server", opbot.PLUGIN)
+		return
+	}
+	log.Debugf("%s: Starting SASL EXTERNAL", opbot.PLUGIN)
+	ea.step = SASL_STEP_EXTERNAL
+	ea.send("AUTHENTICATE " + SASL_EXTERNAL)
+}
+
+// saslExternal sets up an EXTERNAL login, with go-ircevent holding registration
+// until it succeeds, and failing the connect if it doesn't
+func saslExternal(ic *ircevent.Connection, authzid string) {
+	ic.UseSASL = true
+	ic.SASLMech = SASL_PLAIN // all go-ircevent will start
+
+	ea := &externalAuth{authzid: authzid, send: ic.SendRaw}
+	ic.AddCallback("CAP", func(e *ircevent.Event) {
+		if len(e.Arguments) < 2 || e.Arguments[1] != "LS" {
+			return
+		}
+		ea.Lock()
+		ea.step = SASL_STEP_PLAIN
+		ea.Unlock()
+		ic.ClearCallback("AUTHENTICATE")
+		ic.ClearCallback("906")
+		ic.AddCallback("AUTHENTICATE", ea.onAuthenticate)
+		ic.AddCallback("906", ea.on906)
+	})
+}
@@ -0,0 +1,47 @@
+//go:build !make
+// +build !make
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+func TestExternalAuth(t *testing.T) {
+	for _, tc := range []struct {
+		mech, login string
+		useTLS      bool
+		certFile    string
+		ok          bool
+	}{
+		{"EXTERNAL", "", true, "opbot.pem", true},
+		{"external", "opbot", true, "opbot.pem", true},
+		{"EXTERNAL", "", true, "", false},
+		{"EXTERNAL", "", false, "opbot.pem", false},
+	} {
+		if err := checkSASL(tc.mech, tc.login, "", tc.useTLS, tc.certFile); (err == nil) != tc.ok {
+			t.Errorf("Unexpected result for %+v: %v", tc, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		authzid, last string
+	}{
+		{"", "AUTHENTICATE +"},
+		{"opbot", "AUTHENTICATE b3Bib3Q="},
+	} {
+		sent := make([]string, 0)
+		ea := &externalAuth{authzid: tc.authzid, send: func(line string) { sent = append(sent, line) }}
+		plus := &ircevent.Event{Code: "AUTHENTICATE", Arguments: []string{"+"}}
+		ea.onAuthenticate(plus) // go-ircevent has sent AUTHENTICATE PLAIN
+		ea.on906(&ircevent.Event{Code: "906"})
+		ea.onAuthenticate(plus)
+		want := []string{"AUTHENTICATE *", "AUTHENTICATE EXTERNAL", tc.last}
+		if !reflect.DeepEqual(sent, want) {
+			t.Errorf("Expected %q, got %q", want, sent)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Config file support. The file is YAML, or TOML if the file name ends with
+".toml", see opbot.example.yaml for all settings. Flags and environment
+variables win over values from the file.
+
+Instead of "irc" and "channels", the file may list several networks to connect
+to at once. Connection flags are then not used, except that --nick and --user
+(and so "irc.nick" and "irc.user") are the defaults for networks without them.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/oddlid/opbot"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	IRC       IRCConfig       `yaml:"irc" toml:"irc"`
+	Channels  []ChannelConfig `yaml:"channels" toml:"channels"`
+	Networks  []NetworkConfig `yaml:"networks" toml:"networks"` // instead of the above
+	Defaults  PolicyConfig    `yaml:"defaults" toml:"defaults"` // for all channels
+	OPFile    string          `yaml:"opfile" toml:"opfile"`
+	AuditFile *string         `yaml:"auditfile" toml:"auditfile"` // pointer, so it can be set to "" to disable
+	HTTP      HTTPConfig      `yaml:"http" toml:"http"`
+	LogLevel  string          `yaml:"log_level" toml:"log_level"`
+	Debug     bool            `yaml:"debug" toml:"debug"`
+}
+
+type IRCConfig struct {
+	Servers  []string    `yaml:"servers" toml:"servers"` // the first one that answers is used
+	Nick     string      `yaml:"nick" toml:"nick"`
+	User     string      `yaml:"user" toml:"user"`
+	RealName string      `yaml:"realname" toml:"realname"`
+	Password string      `yaml:"password" toml:"password"`
+	QuitMsg  string      `yaml:"quit_message" toml:"quit_message"`
+	TLS      TLSConfig   `yaml:"tls" toml:"tls"`
+	SASL     SASLConfig  `yaml:"sasl" toml:"sasl"`
+	SendQ    SendQConfig `yaml:"sendq" toml:"sendq"`
+}
+
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled" toml:"enabled"`
+	ServerName         string `yaml:"server_name" toml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	CertFile           string `yaml:"cert_file" toml:"cert_file"` // client certificate, for CertFP or SASL EXTERNAL
+	KeyFile            string `yaml:"key_file" toml:"key_file"`   // if not in cert_file
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+}
+
+type SASLConfig struct {
+	Mechanism string `yaml:"mechanism" toml:"mechanism"`
+	Login     string `yaml:"login" toml:"login"`
+	Password  string `yaml:"password" toml:"password"`
+}
+
+// SendQConfig is how fast lines may be sent to the server, see opbot.SendRate
+type SendQConfig struct {
+	Penalty opbot.Duration `yaml:"penalty" toml:"penalty"`
+	Burst   opbot.Duration `yaml:"burst" toml:"burst"`
+}
+
+type NetworkConfig struct {
+	Name      string `yaml:"name" toml:"name"`
+	Namespace string `yaml:"namespace" toml:"namespace"` // for channels in the OPs file, "" to share them
+	IRCConfig `yaml:",inline"`
+	Channels  []ChannelConfig `yaml:"channels" toml:"channels"`
+}
+
+type ChannelConfig struct {
+	Name         string `yaml:"name" toml:"name"`
+	Key          string `yaml:"key" toml:"key"`
+	PolicyConfig `yaml:",inline"`
+}
+
+type PolicyConfig struct {
+	WelcomeMsg      string             `yaml:"wmsg" toml:"wmsg"`
+	WelcomeMode     string             `yaml:"wmsg_mode" toml:"wmsg_mode"`
+	WelcomeCooldown opbot.Duration     `yaml:"wmsg_cooldown" toml:"wmsg_cooldown"`
+	VisitorMsg      string             `yaml:"vmsg" toml:"vmsg"`
+	Flood           *opbot.FloodLimits `yaml:"flood" toml:"flood"`
+	Spam            *opbot.SpamLimits  `yaml:"spam" toml:"spam"`
+	IdleDeop        opbot.Duration     `yaml:"idle_deop" toml:"idle_deop"`
+	BanMask         string             `yaml:"ban_mask" toml:"ban_mask"`
+}
+
+type HTTPConfig struct {
+	Addr    string `yaml:"addr" toml:"addr"`
+	Token   string `yaml:"token" toml:"token"`
+	Metrics bool   `yaml:"metrics" toml:"metrics"`
+}
+
+// _config is the config file given with --config, or empty
+var _config = &Config{}
+
+// _channelFlag tells if channels were given with --channel, and not
+// from the config file. applyConfig sets "channel" from the file, so ctx can't tell.
+var _channelFlag bool
+
+func loadConfig(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if strings.EqualFold(filepath.Ext(filename), ".toml") {
+		_, err = toml.Decode(string(b), cfg)
+	} else {
+		err = yaml.UnmarshalStrict(b, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return cfg, nil
+}
+
+// Validate returns problems that would keep the bot from running as intended
+func (cfg *Config) Validate() []error {
+	errs := validateIRC("irc", cfg.IRC)
+	errs = append(errs, validateChannels("channels", cfg.Channels)...)
+	errs = append(errs, validatePolicy("defaults", cfg.Defaults)...)
+
+	if len(cfg.Networks) > 0 && (len(cfg.IRC.Servers) > 0 || len(cfg.Channels) > 0) {
+		errs = append(errs, fmt.Errorf("networks: can't be combined with irc.servers and channels, move them into a network"))
+	}
+	names := make(map[string]bool)
+	servers := make(map[string]string) // server -> network using it
+	for i, n := range cfg.Networks {
+		prefix := fmt.Sprintf("networks[%d]", i)
+		if n.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is missing", prefix))
+		} else if names[n.Name] {
+			errs = append(errs, fmt.Errorf("%s: %q is listed more than once", prefix, n.Name))
+		}
+		names[n.Name] = true
+		if !opbot.ValidNamespace(n.Namespace) {
+			errs = append(errs, fmt.Errorf("%s: %q is not a valid namespace", prefix, n.Namespace))
+		}
+		if len(n.Servers) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no servers", prefix))
+		}
+		for _, s := range n.Servers {
+			if other, found := servers[s]; found && other != n.Name {
+				errs = append(errs, fmt.Errorf("%s: server %q is also used by %q", prefix, s, other))
+			}
+			servers[s] = n.Name
+		}
+		errs = append(errs, validateIRC(prefix, n.IRCConfig)...)
+		errs = append(errs, validateChannels(prefix+".channels", n.Channels)...)
+	}
+
+	if cfg.HTTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTP.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("http.addr: %s", err.Error()))
+		}
+	} else if cfg.HTTP.Token != "" || cfg.HTTP.Metrics {
+		errs = append(errs, fmt.Errorf("http: token or metrics given, but no addr"))
+	}
+	if cfg.LogLevel != "" {
+		if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+			errs = append(errs, fmt.Errorf("log_level: %s", err.Error()))
+		}
+	}
+	return errs
+}
+
+func validateIRC(prefix string, ic IRCConfig) []error {
+	errs := make([]error, 0)
+	for _, s := range ic.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			errs = append(errs, fmt.Errorf("%s.servers: %q: %s", prefix, s, err.Error()))
+		}
+	}
+	if strings.ContainsAny(ic.Nick, " ,!@*?") {
+		errs = append(errs, fmt.Errorf("%s.nick: %q is not a valid nick", prefix, ic.Nick))
+	}
+	if err := checkSASL(ic.SASL.Mechanism, ic.SASL.Login, ic.SASL.Password, ic.TLS.Enabled, ic.TLS.CertFile); err != nil {
+		errs = append(errs, fmt.Errorf("%s.sasl: %s", prefix, err.Error()))
+	}
+	if ic.TLS.KeyFile != "" && ic.TLS.CertFile == "" {
+		errs = append(errs, fmt.Errorf("%s.tls: key_file given, but no cert_file", prefix))
+	}
+	if ic.SendQ.Penalty < 0 || ic.SendQ.Burst < 0 {
+		errs = append(errs, fmt.Errorf("%s.sendq: penalty and burst can't be negative", prefix))
+	}
+	return errs
+}
+
+func validateChannels(prefix string, channels []ChannelConfig) []error {
+	errs := make([]error, 0)
+	seen := make(map[string]bool)
+	for i, ch := range channels {
+		if !strings.HasPrefix(ch.Name, "#") && !strings.HasPrefix(ch.Name, "&") {
+			errs = append(errs, fmt.Errorf("%s[%d]: %q is not a valid channel name", prefix, i, ch.Name))
+		}
+		if strings.ContainsAny(ch.Name+ch.Key, " ,") {
+			errs = append(errs, fmt.Errorf("%s[%d]: name and key can't contain spaces or commas", prefix, i))
+		}
+		if seen[strings.ToLower(ch.Name)] {
+			errs = append(errs, fmt.Errorf("%s[%d]: %s is listed more than once", prefix, i, ch.Name))
+		}
+		seen[strings.ToLower(ch.Name)] = true
+		errs = append(errs, validatePolicy(fmt.Sprintf("%s[%d]", prefix, i), ch.PolicyConfig)...)
+	}
+	return errs
+}
+
+func validatePolicy(prefix string, p PolicyConfig) []error {
+	errs := make([]error, 0)
+	if err := opbot.ValidateWMsg(p.WelcomeMsg); err != nil {
+		errs = append(errs, fmt.Errorf("%s.wmsg: %s", prefix, err.Error()))
+	}
+	if err := opbot.ValidateWMsg(p.VisitorMsg); err != nil {
+		errs = append(errs, fmt.Errorf("%s.vmsg: %s", prefix, err.Error()))
+	}
+	if p.WelcomeMode != "" && !opbot.ValidWMode(p.WelcomeMode) {
+		errs = append(errs, fmt.Errorf("%s.wmsg_mode: %q is not one of %s, %s or %s", prefix, p.WelcomeMode, opbot.WMODE_CHANNEL, opbot.WMODE_NOTICE, opbot.WMODE_PRIVATE))
+	}
+	if p.Flood != nil {
+		if err := p.Flood.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.flood: %s", prefix, err.Error()))
+		}
+	}
+	if p.Spam != nil {
+		if err := p.Spam.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.spam: %s", prefix, err.Error()))
+		}
+	}
+	if p.WelcomeCooldown < 0 {
+		errs = append(errs, fmt.Errorf("%s.wmsg_cooldown: can't be negative", prefix))
+	}
+	if p.IdleDeop < 0 {
+		errs = append(errs, fmt.Errorf("%s.idle_deop: can't be negative", prefix))
+	}
+	if p.BanMask != "" && !opbot.ValidBanMask(p.BanMask) {
+		errs = append(errs, fmt.Errorf("%s.ban_mask: %q is not a mask like *!*@host", prefix, p.BanMask))
+	}
+	return errs
+}
+
+// applyConfig loads the file given by --config, and sets the global flags that weren't
+// given on the command line or in the environment, from it
+func applyConfig(ctx *cli.Context) error {
+	_channelFlag = ctx.IsSet("channel")
+	filename := ctx.String("config")
+	if filename == "" {
+		return nil
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		return err
+	}
+	_config = cfg
+
+	set := func(flag, value string) error {
+		if value == "" || ctx.IsSet(flag) {
+			return nil
+		}
+		return ctx.Set(flag, value)
+	}
+	setBool := func(flag string, value bool) error {
+		if !value {
+			return nil
+		}
+		return set(flag, "true")
+	}
+
+	errs := []error{
+		set("nick", cfg.IRC.Nick),
+		set("user", cfg.IRC.User),
+		set("password", cfg.IRC.Password),
+		set("quit-msg", cfg.IRC.QuitMsg),
+		setBool("tls", cfg.IRC.TLS.Enabled),
+		set("tls-cert", cfg.IRC.TLS.CertFile),
+		set("tls-key", cfg.IRC.TLS.KeyFile),
+		set("tls-ca", cfg.IRC.TLS.CAFile),
+		setBool("tls-skip-verify", cfg.IRC.TLS.InsecureSkipVerify),
+		set("sasl-mech", cfg.IRC.SASL.Mechanism),
+		set("sasl-login", cfg.IRC.SASL.Login),
+		set("sasl-password", cfg.IRC.SASL.Password),
+		set("opfile", cfg.OPFile),
+		set("http-addr", cfg.HTTP.Addr),
+		set("http-token", cfg.HTTP.Token),
+		setBool("metrics", cfg.HTTP.Metrics),
+		set("log-level", cfg.LogLevel),
+		setBool("debug", cfg.Debug),
+	}
+	if cfg.AuditFile != nil && !ctx.IsSet("auditfile") {
+		errs = append(errs, ctx.Set("auditfile", *cfg.AuditFile))
+	}
+	if !ctx.IsSet("channel") {
+		for _, ch := range cfg.Channels {
+			errs = append(errs, ctx.Set("channel", strings.TrimSpace(ch.Name+" "+ch.Key)))
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkConfigs gives the networks from the config file, or else the one set up by flags
+func networkConfigs(ctx *cli.Context) []NetworkConfig {
+	if len(_config.Networks) > 0 {
+		nets := make([]NetworkConfig, len(_config.Networks))
+		copy(nets, _config.Networks)
+		for i := range nets {
+			if nets[i].Nick == "" {
+				nets[i].Nick = ctx.String("nick")
+			}
+			if nets[i].User == "" {
+				nets[i].User = ctx.String("user")
+			}
+			if nets[i].RealName == "" {
+				nets[i].RealName = _config.IRC.RealName
+			}
+			if nets[i].SendQ == (SendQConfig{}) {
+				nets[i].SendQ = _config.IRC.SendQ
+			}
+		}
+		return nets
+	}
+
+	nc := NetworkConfig{
+		IRCConfig: IRCConfig{
+			Servers:  _config.IRC.Servers,
+			Nick:     ctx.String("nick"),
+			User:     ctx.String("user"),
+			RealName: _config.IRC.RealName,
+			Password: ctx.String("password"),
+			TLS: TLSConfig{
+				Enabled:            ctx.Bool("tls"),
+				ServerName:         _config.IRC.TLS.ServerName,
+				InsecureSkipVerify: ctx.Bool("tls-skip-verify"),
+				CertFile:           ctx.String("tls-cert"),
+				KeyFile:            ctx.String("tls-key"),
+				CAFile:             ctx.String("tls-ca"),
+			},
+			SASL: SASLConfig{
+				Mechanism: ctx.String("sasl-mech"),
+				Login:     ctx.String("sasl-login"),
+				Password:  ctx.String("sasl-password"),
+			},
+			SendQ: _config.IRC.SendQ,
+		},
+	}
+	if ctx.IsSet("server") || len(nc.Servers) == 0 {
+		nc.Servers = []string{ctx.String("server")}
+	}
+	// Named by the first server, and not the one picked to connect to, so that the name
+	// bans and modes to lift are kept under is the same after a restart
+	nc.Name = nc.Servers[0]
+	for _, ch := range ctx.StringSlice("channel") {
+		fields := strings.Fields(ch)
+		if len(fields) == 0 {
+			continue
+		}
+		cc := ChannelConfig{Name: fields[0]}
+		if len(fields) > 1 {
+			cc.Key = fields[1]
+		}
+		nc.Channels = append(nc.Channels, cc)
+	}
+	return []NetworkConfig{nc}
+}
+
+// channelSpecs gives channels as irc.Config wants them, "#chan key" for channels with a key
+func channelSpecs(channels []ChannelConfig) []string {
+	specs := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		specs = append(specs, strings.TrimSpace(ch.Name+" "+ch.Key))
+	}
+	return specs
+}
+
+// pickServer returns the first server that answers, if there's more than one
+func pickServer(servers []string) string {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	for _, s := range servers {
+		conn, err := net.DialTimeout("tcp", s, 10*time.Second)
+		if err != nil {
+			log.Warnf("%s: %s does not answer: %s", opbot.PLUGIN, s, err.Error())
+			continue
+		}
+		conn.Close()
+		return s
+	}
+	log.Warnf("%s: No server answered, trying %s anyway", opbot.PLUGIN, servers[0])
+	return servers[0]
+}
+
+func (p PolicyConfig) policy() opbot.Policy {
+	return opbot.Policy{
+		WelcomeMsg:      p.WelcomeMsg,
+		WelcomeMode:     p.WelcomeMode,
+		WelcomeCooldown: time.Duration(p.WelcomeCooldown),
+		VisitorMsg:      p.VisitorMsg,
+		Flood:           p.Flood,
+		Spam:            p.Spam,
+		IdleDeop:        time.Duration(p.IdleDeop),
+		BanMask:         p.BanMask,
+	}
+}
+
+// applyPolicies passes channel defaults from the config file on to the bot
+func applyPolicies() {
+	opbot.SetPolicy("", _config.Defaults.policy())
+	set := func(namespace string, channels []ChannelConfig) {
+		for _, ch := range channels {
+			opbot.SetPolicy(opbot.Key(namespace, ch.Name), ch.policy())
+		}
+	}
+	set("", _config.Channels)
+	for _, n := range _config.Networks {
+		set(n.Namespace, n.Channels)
+	}
+}
+
+func configCheck(ctx *cli.Context) error {
+	filename := ctx.Args().First()
+	if filename == "" {
+		filename = ctx.GlobalString("config")
+	}
+	if filename == "" {
+		return cli.NewExitError("Usage: opbot config check <file>, or give the file with --config", E_USAGE)
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_INVALID)
+	}
+	errs := cfg.Validate()
+	for _, e := range errs {
+		fmt.Fprintln(os.Stderr, e.Error())
+	}
+	if len(errs) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d problem(s) found in %s", len(errs), filename), E_INVALID)
+	}
+	fmt.Printf("%s is OK\n", filename)
+	return nil
+}
+
+func configCommand() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "Work with config files",
+		Subcommands: []cli.Command{
+			{
+				Name:      "check",
+				Usage:     "Check a config file for errors",
+				ArgsUsage: "[file, if not given with --config]",
+				Action:    configCheck,
+			},
+		},
+	}
+}
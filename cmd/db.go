@@ -0,0 +1,428 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Subcommands for managing the OPs file without going through IRC, e.g. for
+bootstrapping a new channel. The running bot reloads the file when it sees
+it has changed, and the file is always replaced atomically when saved. Before
+saving, we check that the file hasn't changed since we loaded it, and start
+over if it has, so changes the bot saved meanwhile aren't lost. There's still
+a moment between the check and the save where they could be, so prefer IRC
+or the admin API for changes while the bot is live.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oddlid/opbot"
+	"github.com/urfave/cli"
+)
+
+const (
+	MODIFY_TRIES int = 3 // times to start over if the OPs file changes while we modify it
+)
+
+// _errChanged is returned by saveOPs if the OPs file has changed since it was loaded
+var _errChanged = errors.New("changed while we were at it, probably by the running bot")
+
+// opsModTime gives the modification time of the OPs file, or the zero time if there is none
+func opsModTime(ctx *cli.Context) time.Time {
+	fi, err := os.Stat(ctx.GlobalString("opfile"))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// saveOPs saves ops to the OPs file, unless the file has changed since mtime
+func saveOPs(ctx *cli.Context, ops *opbot.OPData, mtime time.Time) error {
+	if !opsModTime(ctx).Equal(mtime) {
+		return _errChanged
+	}
+	return ops.SaveFile(ctx.GlobalString("opfile"))
+}
+
+// loadOPs reads the OPs file given by --opfile. A missing file gives an empty list.
+func loadOPs(ctx *cli.Context) (*opbot.OPData, error) {
+	ops := opbot.NewOPData()
+	file, err := os.Open(ctx.GlobalString("opfile"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ops, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	if err := ops.Load(file); err != nil {
+		return nil, fmt.Errorf("%s: %s", ctx.GlobalString("opfile"), err.Error())
+	}
+	return ops, nil
+}
+
+// modifyOPs loads the OPs file, runs fn on it, and saves the file if fn returns true.
+// If the file changes before it's saved, it starts over, up to MODIFY_TRIES times.
+func modifyOPs(ctx *cli.Context, fn func(ops *opbot.OPData) (bool, error)) error {
+	err := _errChanged
+	for try := 0; try < MODIFY_TRIES && err == _errChanged; try++ {
+		mtime := opsModTime(ctx)
+		ops, lerr := loadOPs(ctx)
+		if lerr != nil {
+			return cli.NewExitError(lerr.Error(), E_OPFILE)
+		}
+		dirty, ferr := fn(ops)
+		if ferr != nil {
+			return cli.NewExitError(ferr.Error(), E_USAGE)
+		}
+		if !dirty {
+			return nil
+		}
+		err = saveOPs(ctx, ops, mtime)
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", ctx.GlobalString("opfile"), err.Error()), E_OPFILE)
+	}
+	return nil
+}
+
+// needArgs returns an error with usage info if ctx has fewer than n arguments
+func needArgs(ctx *cli.Context, n int) error {
+	if ctx.NArg() < n {
+		return cli.NewExitError(
+			fmt.Sprintf("Usage: %s %s", ctx.Command.HelpName, ctx.Command.ArgsUsage),
+			E_USAGE,
+		)
+	}
+	return nil
+}
+
+func dbLs(ctx *cli.Context) error {
+	ops, err := loadOPs(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+
+	channels := ops.ChannelNames()
+	if ctx.NArg() > 0 {
+		channels = ctx.Args()
+	}
+	for _, name := range channels {
+		c := ops.Get(name)
+		fmt.Printf("%s\n", name)
+		if c.WelcomeMsg != "" {
+			fmt.Printf("  wmsg: %q\n", c.WelcomeMsg)
+		}
+		if c.VisitorMsg != "" {
+			fmt.Printf("  vmsg: %q\n", c.VisitorMsg)
+		}
+		if len(c.VisitorExclude) > 0 {
+			fmt.Printf("  vmsg exclude: %s\n", strings.Join(c.VisitorExclude, " "))
+		}
+		if c.Flood != nil {
+			fmt.Printf("  flood: %s\n", c.Flood.String())
+		}
+		if c.Spam != nil {
+			fmt.Printf("  spam: %s\n", c.Spam.String())
+		}
+		for _, tm := range c.Lifts {
+			fmt.Printf("  lift %s %s at %s\n", tm.Mode, tm.Param, tm.Until.Format(time.RFC3339))
+		}
+		if c.WelcomeMode != "" {
+			fmt.Printf("  wmsg mode: %s\n", c.WelcomeMode)
+		}
+		if c.WelcomeCooldown > 0 {
+			fmt.Printf("  wmsg cooldown: %s\n", time.Duration(c.WelcomeCooldown))
+		}
+		if d := c.GetIdleDeop(); d > 0 {
+			fmt.Printf("  idle deop: %s\n", d)
+		}
+		for _, nick := range c.Nicks() {
+			extra := ""
+			if t, found := c.Expiry(nick); found {
+				extra += fmt.Sprintf(" (expires %s)", t.Format(time.RFC3339))
+			}
+			for _, w := range c.Schedule(nick) {
+				extra += fmt.Sprintf(" [%s]", w.String())
+			}
+			fmt.Printf("  %s%s: %s\n", nick, extra, strings.Join(c.Hostmasks(nick), " "))
+			if g := c.Greeting(nick); g != "" {
+				fmt.Printf("    greeting: %q\n", g)
+			}
+		}
+		for _, nick := range c.VoiceNicks() {
+			fmt.Printf("  +v %s: %s\n", nick, strings.Join(c.VoiceHostmasks(nick), " "))
+		}
+	}
+	return nil
+}
+
+func dbAdd(ctx *cli.Context) error {
+	if err := needArgs(ctx, 3); err != nil {
+		return err
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		c := ops.Get(channel)
+		dirty := false
+		for _, mask := range ctx.Args()[2:] {
+			if !opbot.ValidMask(mask) {
+				return dirty, fmt.Errorf("invalid hostmask %q, expected nick!user@host", mask)
+			}
+			if c.Add(nick, mask) {
+				dirty = true
+				fmt.Printf("Added %q with hostmask %q to %s\n", nick, mask, channel)
+			} else {
+				fmt.Printf("Hostmask %q already in list for %q in %s\n", mask, nick, channel)
+			}
+		}
+		return dirty, nil
+	})
+}
+
+func dbDel(ctx *cli.Context) error {
+	if err := needArgs(ctx, 2); err != nil {
+		return err
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		c := ops.Get(channel)
+		if !c.Has(nick) {
+			return false, fmt.Errorf("%q is not in the OPs list for %s", nick, channel)
+		}
+		c.Remove(nick)
+		fmt.Printf("Removed %q from %s\n", nick, channel)
+		return true, nil
+	})
+}
+
+func dbMaskAdd(ctx *cli.Context) error {
+	if err := needArgs(ctx, 3); err != nil {
+		return err
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		c := ops.Get(channel)
+		if !c.Has(nick) {
+			return false, fmt.Errorf("%q is not in the OPs list for %s, use \"db add\" first", nick, channel)
+		}
+		dirty := false
+		for _, mask := range ctx.Args()[2:] {
+			if !opbot.ValidMask(mask) {
+				return dirty, fmt.Errorf("invalid hostmask %q, expected nick!user@host", mask)
+			}
+			if c.Add(nick, mask) {
+				dirty = true
+				fmt.Printf("Added hostmask %q to %q in %s\n", mask, nick, channel)
+			}
+		}
+		return dirty, nil
+	})
+}
+
+func dbMaskDel(ctx *cli.Context) error {
+	if err := needArgs(ctx, 3); err != nil {
+		return err
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		c := ops.Get(channel)
+		dirty := false
+		for _, mask := range ctx.Args()[2:] {
+			if c.RemoveHostmask(nick, mask) {
+				dirty = true
+				fmt.Printf("Removed hostmask %q from %q in %s\n", mask, nick, channel)
+			} else {
+				fmt.Printf("No hostmask %q for %q in %s\n", mask, nick, channel)
+			}
+		}
+		return dirty, nil
+	})
+}
+
+func dbMaskLs(ctx *cli.Context) error {
+	if err := needArgs(ctx, 2); err != nil {
+		return err
+	}
+	ops, err := loadOPs(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	c := ops.Get(channel)
+	if !c.Has(nick) {
+		return cli.NewExitError(fmt.Sprintf("%q is not in the OPs list for %s", nick, channel), E_USAGE)
+	}
+	for _, mask := range c.Hostmasks(nick) {
+		fmt.Println(mask)
+	}
+	return nil
+}
+
+func dbVoiceAdd(ctx *cli.Context) error {
+	if err := needArgs(ctx, 3); err != nil {
+		return err
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		c := ops.Get(channel)
+		dirty := false
+		for _, mask := range ctx.Args()[2:] {
+			if !opbot.ValidMask(mask) {
+				return dirty, fmt.Errorf("invalid hostmask %q, expected nick!user@host", mask)
+			}
+			if c.AddVoice(nick, mask) {
+				dirty = true
+				fmt.Printf("Added voice for %q with hostmask %q to %s\n", nick, mask, channel)
+			}
+		}
+		return dirty, nil
+	})
+}
+
+func dbVoiceDel(ctx *cli.Context) error {
+	if err := needArgs(ctx, 2); err != nil {
+		return err
+	}
+	channel, nick := ctx.Args().Get(0), ctx.Args().Get(1)
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		if !ops.Get(channel).RemoveVoice(nick) {
+			return false, fmt.Errorf("%q is not in the voice list for %s", nick, channel)
+		}
+		fmt.Printf("Removed voice for %q from %s\n", nick, channel)
+		return true, nil
+	})
+}
+
+func dbWmsgSet(ctx *cli.Context) error {
+	if err := needArgs(ctx, 1); err != nil {
+		return err
+	}
+	channel := ctx.Args().Get(0)
+	msg := strings.Join(ctx.Args()[1:], " ")
+	if err := opbot.ValidateWMsg(msg); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Invalid welcome message: %s", err.Error()), E_INVALID)
+	}
+	return modifyOPs(ctx, func(ops *opbot.OPData) (bool, error) {
+		c := ops.Get(channel)
+		c.Lock()
+		c.WelcomeMsg = msg
+		c.Unlock()
+		fmt.Printf("Welcome message for %s: %q\n", channel, msg)
+		return true, nil
+	})
+}
+
+func dbValidate(ctx *cli.Context) error {
+	ops, err := loadOPs(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+	errs := ops.Validate()
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	if len(errs) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d problem(s) found in %s", len(errs), ctx.GlobalString("opfile")), E_INVALID)
+	}
+	fmt.Printf("%s is OK\n", ctx.GlobalString("opfile"))
+	return nil
+}
+
+func dbCommand() cli.Command {
+	return cli.Command{
+		Name:  "db",
+		Usage: "Manage the OPs file given by --opfile directly, without IRC",
+		Subcommands: []cli.Command{
+			{
+				Name:      "ls",
+				Usage:     "List OPs, for all or the given channels",
+				ArgsUsage: "[channel...]",
+				Action:    dbLs,
+			},
+			{
+				Name:      "add",
+				Usage:     "Add nick with one or more hostmasks",
+				ArgsUsage: "<channel> <nick> <hostmask...>",
+				Action:    dbAdd,
+			},
+			{
+				Name:      "del",
+				Usage:     "Remove nick",
+				ArgsUsage: "<channel> <nick>",
+				Action:    dbDel,
+			},
+			{
+				Name:  "mask",
+				Usage: "Manage hostmasks for a nick",
+				Subcommands: []cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Add hostmask(s) to nick",
+						ArgsUsage: "<channel> <nick> <hostmask...>",
+						Action:    dbMaskAdd,
+					},
+					{
+						Name:      "del",
+						Usage:     "Remove hostmask(s) from nick",
+						ArgsUsage: "<channel> <nick> <hostmask...>",
+						Action:    dbMaskDel,
+					},
+					{
+						Name:      "ls",
+						Usage:     "List hostmasks for nick",
+						ArgsUsage: "<channel> <nick>",
+						Action:    dbMaskLs,
+					},
+				},
+			},
+			{
+				Name:  "voice",
+				Usage: "Manage nicks that get voice on join",
+				Subcommands: []cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Add nick with one or more hostmasks",
+						ArgsUsage: "<channel> <nick> <hostmask...>",
+						Action:    dbVoiceAdd,
+					},
+					{
+						Name:      "del",
+						Usage:     "Remove nick",
+						ArgsUsage: "<channel> <nick>",
+						Action:    dbVoiceDel,
+					},
+				},
+			},
+			{
+				Name:  "wmsg",
+				Usage: "Manage the welcome message for a channel",
+				Subcommands: []cli.Command{
+					{
+						Name:      "set",
+						Usage:     "Set the welcome message. Leave out the message to remove it.",
+						ArgsUsage: "<channel> [message...]",
+						Action:    dbWmsgSet,
+					},
+				},
+			},
+			dbExportCommand(),
+			dbImportCommand(),
+			{
+				Name:   "validate",
+				Usage:  "Check the OPs file for errors",
+				Action: dbValidate,
+			},
+		},
+	}
+}
@@ -0,0 +1,223 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Import and export of the OPs file in other formats, see opbot/convert.go.
+Eggdrop userfiles and ChanServ listings can be imported, but not exported,
+see opbot/importers.go.
+*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oddlid/opbot"
+	"github.com/urfave/cli"
+)
+
+const (
+	FMT_CSV      string = "csv"
+	FMT_JSON     string = "json"
+	FMT_YAML     string = "yaml"
+	FMT_EGGDROP  string = "eggdrop"
+	FMT_CHANSERV string = "chanserv"
+)
+
+// format returns the value of --format, or guesses it from the file extension.
+// Without either, e.g. for stdin or stdout, it's JSON, like the OPs file.
+func format(ctx *cli.Context, filename string) (string, error) {
+	f := strings.ToLower(ctx.String("format"))
+	if f == "" {
+		f = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch f {
+	case "":
+		return FMT_JSON, nil
+	case FMT_CSV, FMT_JSON, FMT_EGGDROP, FMT_CHANSERV:
+		return f, nil
+	case FMT_YAML, "yml":
+		return FMT_YAML, nil
+	case "user":
+		return FMT_EGGDROP, nil
+	}
+	return "", fmt.Errorf(
+		"Unknown format %q, use one of: %s, %s, %s, %s (import only), %s (import only)",
+		f, FMT_CSV, FMT_JSON, FMT_YAML, FMT_EGGDROP, FMT_CHANSERV,
+	)
+}
+
+func dbExport(ctx *cli.Context) error {
+	filename := ctx.Args().First()
+	fmtName, err := format(ctx, filename)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_USAGE)
+	}
+	if fmtName == FMT_EGGDROP || fmtName == FMT_CHANSERV {
+		return cli.NewExitError(fmt.Sprintf("Export to %s is not supported", fmtName), E_USAGE)
+	}
+	ops, err := loadOPs(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+
+	var w io.Writer = os.Stdout
+	if filename != "" && filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return cli.NewExitError(err.Error(), E_OPFILE)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch fmtName {
+	case FMT_CSV:
+		err = ops.WriteCSV(w)
+	case FMT_YAML:
+		err = ops.WriteYAML(w)
+	case FMT_JSON:
+		_, err = ops.Save(w)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+	return nil
+}
+
+func readImport(ctx *cli.Context, fmtName string, r io.Reader) (*opbot.OPData, error) {
+	switch fmtName {
+	case FMT_CSV:
+		return opbot.ReadCSV(r)
+	case FMT_YAML:
+		return opbot.ReadYAML(r)
+	case FMT_EGGDROP:
+		return opbot.ReadEggdrop(r, ctx.String("channel"))
+	case FMT_CHANSERV:
+		return opbot.ReadChanServ(r, ctx.String("channel"), ctx.String("mask-template"))
+	}
+	ops := opbot.NewOPData()
+	err := ops.Load(r)
+	return ops, err
+}
+
+func dbImport(ctx *cli.Context) error {
+	if err := needArgs(ctx, 1); err != nil {
+		return err
+	}
+	filename := ctx.Args().First()
+	fmtName, err := format(ctx, filename)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_USAGE)
+	}
+
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return cli.NewExitError(err.Error(), E_OPFILE)
+		}
+		defer file.Close()
+		r = file
+	}
+	src, err := readImport(ctx, fmtName, r)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", filename, err.Error()), E_INVALID)
+	}
+
+	return importOPs(ctx, src)
+}
+
+// importOPs merges src into, or replaces, the OPs file, printing conflicts and a diff.
+// Nothing is written with --dry-run.
+func importOPs(ctx *cli.Context, src *opbot.OPData) error {
+	if errs := src.Validate(); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", e.Error())
+		}
+	}
+
+	mtime := opsModTime(ctx)
+	ops, err := loadOPs(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+	// Load a second copy to merge into, so we have the original to diff against
+	merged, err := loadOPs(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_OPFILE)
+	}
+	if ctx.Bool("replace") {
+		merged = src
+	} else {
+		for _, c := range merged.Merge(src) {
+			fmt.Fprintf(os.Stderr, "Conflict: %s\n", c)
+		}
+	}
+
+	diff := ops.Diff(merged)
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+	if len(diff) == 0 {
+		fmt.Println("No changes")
+		return nil
+	}
+	if ctx.Bool("dry-run") {
+		return nil
+	}
+	if err := saveOPs(ctx, merged, mtime); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %s, nothing imported", ctx.GlobalString("opfile"), err.Error()), E_OPFILE)
+	}
+	return nil
+}
+
+func dbExportCommand() cli.Command {
+	return cli.Command{
+		Name:      "export",
+		Usage:     "Export the OPs file to another format",
+		ArgsUsage: "[file, or - for stdout]",
+		Action:    dbExport,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "format, f",
+				Usage: "Output `format`: csv, json or yaml. Guessed from the file extension if not given, JSON without one.",
+			},
+		},
+	}
+}
+
+func dbImportCommand() cli.Command {
+	return cli.Command{
+		Name:      "import",
+		Usage:     "Import OPs from another file, merging with or replacing the OPs file",
+		ArgsUsage: "<file, or - for stdin>",
+		Action:    dbImport,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "format, f",
+				Usage: "Input `format`: csv, json, yaml, eggdrop or chanserv. Guessed from the file extension if not given, JSON without one.",
+			},
+			cli.StringFlag{
+				Name:  "channel, c",
+				Usage: "Only import this `channel` from an Eggdrop userfile, or which channel a ChanServ listing is for",
+			},
+			cli.StringFlag{
+				Name:  "mask-template",
+				Usage: "Hostmask for ChanServ account entries, with %s replaced by the account, e.g. \"%s!*@user/%s\"",
+			},
+			cli.BoolFlag{
+				Name:  "replace",
+				Usage: "Replace the OPs file with the imported data, instead of merging",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run, n",
+				Usage: "Only show what would change, don't write anything",
+			},
+		},
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !make
+// +build !make
+
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		flag, filename, expected string
+	}{
+		{"", "", FMT_JSON},
+		{"", "-", FMT_JSON},
+		{"", "ops.yml", FMT_YAML},
+		{"", "opbot.user", FMT_EGGDROP},
+		{"csv", "", FMT_CSV},
+		{"CSV", "ops.json", FMT_CSV},
+		{"", "ops.txt", ""},
+	} {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("format", tc.flag, "")
+		f, err := format(cli.NewContext(nil, set, nil), tc.filename)
+		if f != tc.expected || (err == nil) != (tc.expected != "") {
+			t.Errorf("Expected %q for %q and %q, got %q: %v", tc.expected, tc.flag, tc.filename, f, err)
+		}
+	}
+}
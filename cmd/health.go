@@ -0,0 +1,76 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Checks the health of a running bot through its /healthz or /readyz endpoint,
+for use as a Docker HEALTHCHECK, where there's no curl or wget in the image.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func healthcheck(ctx *cli.Context) error {
+	addr := ctx.GlobalString("http-addr")
+	if addr == "" {
+		return cli.NewExitError("--http-addr is needed to know where to check", E_USAGE)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_USAGE)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	path := "/healthz"
+	if ctx.Bool("ready") {
+		path = "/readyz"
+	}
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path)
+
+	client := &http.Client{Timeout: ctx.Duration("timeout")}
+	resp, err := client.Get(url)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNHEALTHY)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !ctx.Bool("quiet") {
+		fmt.Print(string(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", url, resp.Status), E_UNHEALTHY)
+	}
+	return nil
+}
+
+func healthCommand() cli.Command {
+	return cli.Command{
+		Name:   "healthcheck",
+		Usage:  "Check the health of the bot running with the same --http-addr. Exits non-zero if unhealthy.",
+		Action: healthcheck,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "ready",
+				Usage: "Check readiness (joined all channels, OPs file loaded) instead of just being connected",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "Give up after `duration`",
+				Value: 5 * time.Second,
+			},
+			cli.BoolFlag{
+				Name:  "quiet, q",
+				Usage: "Don't print the status",
+			},
+		},
+	}
+}
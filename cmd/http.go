@@ -0,0 +1,57 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Optional HTTP server for health checks, the admin API (see opbot/api.go) and Prometheus metrics
+*/
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/oddlid/opbot"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// startHTTP starts serving in the background, if --http-addr is given. /healthz and /readyz
+// are always served, the admin API if --http-token is set, and /metrics with --metrics.
+// Returns an error if it can't listen on the address.
+func startHTTP(ctx *cli.Context) error {
+	addr := ctx.String("http-addr")
+	token := ctx.String("http-token")
+	metrics := ctx.Bool("metrics")
+	if addr == "" {
+		if metrics {
+			return cli.NewExitError("--metrics needs --http-addr", E_USAGE)
+		}
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", opbot.HealthHandler())
+	mux.Handle("/readyz", opbot.ReadyHandler())
+	log.Infof("%s: Serving health checks on %s/healthz and %s/readyz", opbot.PLUGIN, addr, addr)
+	if token != "" {
+		mux.Handle(opbot.API_PREFIX, opbot.APIHandler(token))
+		log.Infof("%s: Serving admin API on %s%s", opbot.PLUGIN, addr, opbot.API_PREFIX)
+	}
+	if metrics {
+		mux.Handle("/metrics", opbot.MetricsHandler())
+		log.Infof("%s: Serving metrics on %s/metrics", opbot.PLUGIN, addr)
+	}
+
+	// Listen before going into the background, so that e.g. a port in use fails startup
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_HTTP)
+	}
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Errorf("%s: HTTP server stopped: %s", opbot.PLUGIN, err.Error())
+		}
+	}()
+	return nil
+}
@@ -1,3 +1,4 @@
+//go:build !make
 // +build !make
 
 package main
@@ -9,22 +10,30 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	//"github.com/go-chat-bot/bot"
-	"github.com/go-chat-bot/bot/irc"
 	"github.com/oddlid/opbot"
 	"github.com/urfave/cli"
 )
 
 const (
-	DEF_ADDR   string = "irc.oftc.net:6697"
+	DEF_ADDR string = "irc.oftc.net:6697"
 	//DEF_ADDR   string = "ix1.undernet.org:6667" // set UseTLS to default false with Undernet
 	DEF_USER   string = "opbot"
 	DEF_NICK   string = "opbot"
 	DEF_OPFILE string = opbot.DEF_OPFILE
+	DEF_AUDIT  string = opbot.DEF_AUDITFILE
+	DEF_QUIT   string = "OPBot shutting down"
 )
 
 const (
 	E_OK = iota
 	E_INIT_OPBOT
+	E_READ_AUDIT
+	E_OPFILE
+	E_USAGE
+	E_INVALID
+	E_UNHEALTHY
+	E_SIGNAL
+	E_HTTP
 )
 
 var (
@@ -33,35 +42,44 @@ var (
 	VERSION    string
 )
 
-
 func entryPoint(ctx *cli.Context) error {
 	//fmt.Println(opbot.HelpMsg())
 	//return nil
 
-
 	opfile := ctx.String("opfile")
-	cfg := &irc.Config{
-		Server:   ctx.String("server"),
-		User:     ctx.String("user"),
-		Nick:     ctx.String("nick"),
-		Password: ctx.String("password"),
-		Channels: ctx.StringSlice("channel"),
-		UseTLS:   ctx.Bool("tls"),
-		Debug:    ctx.Bool("debug"),
+	nets := make([]*opbot.Network, 0, 1)
+	for _, nc := range networkConfigs(ctx) {
+		n, err := setupNetwork(nc, ctx.Bool("debug"))
+		if err != nil {
+			if nc.Name != "" {
+				return cli.NewExitError(fmt.Sprintf("%s: %s", nc.Name, err.Error()), E_INVALID)
+			}
+			return cli.NewExitError(err.Error(), E_INVALID)
+		}
+		nets = append(nets, n)
 	}
 
-	b, ic := irc.SetUpConn(cfg)
-	err := opbot.InitBot(b, cfg, ic, opfile)
+	opbot.SetAuditFile(ctx.String("auditfile"))
+	applyPolicies()
+
+	err := opbot.InitNetworks(opfile, nets...)
 	if err != nil {
 		return cli.NewExitError(err.Error(), E_INIT_OPBOT)
 	}
 
-	irc.Run(nil) // pass nil as we've ran SetUpConn with cfg
+	if err := startHTTP(ctx); err != nil {
+		return err
+	}
+
+	handleSignals(ctx, nets)
+	runNetworks(nets)
 
+	if code := shutdownCode(); code != E_OK {
+		return cli.NewExitError("Shut down with unsaved changes", code)
+	}
 	return nil
 }
 
-
 func main() {
 	app := cli.NewApp()
 	app.Name = "opbot"
@@ -76,6 +94,11 @@ func main() {
 	}
 	app.Usage = "Run irc OP bot"
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Load settings from YAML or TOML `file`. Flags and environment variables override settings from the file.",
+			EnvVar: "OPBOT_CONFIG",
+		},
 		cli.StringFlag{
 			Name:   "server, s",
 			Usage:  "IRC server `address`",
@@ -108,12 +131,74 @@ func main() {
 			Usage:  "Use secure TLS connection",
 			EnvVar: "IRC_TLS",
 		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "Client certificate PEM `file`, for CertFP or SASL EXTERNAL. May also hold the key.",
+			EnvVar: "IRC_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "Private key PEM `file` for --tls-cert, if not in the same file",
+			EnvVar: "IRC_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca",
+			Usage:  "CA certificates PEM `file` to verify the server with, instead of the system ones",
+			EnvVar: "IRC_TLS_CA",
+		},
+		cli.BoolFlag{
+			Name:   "tls-skip-verify",
+			Usage:  "Don't verify the TLS certificate of the server. Avoid if you can.",
+			EnvVar: "IRC_TLS_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "sasl-mech",
+			Usage:  "SASL `mechanism` for logging in to services: PLAIN or EXTERNAL (needs --tls-cert). Disabled if not set.",
+			EnvVar: "IRC_SASL_MECH",
+		},
+		cli.StringFlag{
+			Name:   "sasl-login",
+			Usage:  "SASL `account` name. Optional for EXTERNAL.",
+			EnvVar: "IRC_SASL_LOGIN",
+		},
+		cli.StringFlag{
+			Name:   "sasl-password",
+			Usage:  "SASL `password` for PLAIN",
+			EnvVar: "IRC_SASL_PASS",
+		},
+		cli.StringFlag{
+			Name:   "quit-msg",
+			Usage:  "QUIT `message` when shutting down on SIGTERM or SIGINT",
+			EnvVar: "OPBOT_QUIT_MSG",
+			Value:  DEF_QUIT,
+		},
 		cli.StringFlag{
 			Name:   "opfile",
 			Usage:  "JSON `file` for loading/saving OPs userlist",
 			EnvVar: "OPBOT_FILE",
 			Value:  DEF_OPFILE,
 		},
+		cli.StringFlag{
+			Name:   "auditfile",
+			Usage:  "JSON lines `file` for logging changes to the OPs list. Set to \"\" to disable.",
+			EnvVar: "OPBOT_AUDITFILE",
+			Value:  DEF_AUDIT,
+		},
+		cli.StringFlag{
+			Name:   "http-addr",
+			Usage:  "Serve health checks, and the admin API and/or metrics if enabled, on `address`, e.g. \"localhost:8080\". Disabled if not set.",
+			EnvVar: "OPBOT_HTTP_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "http-token",
+			Usage:  "Bearer `token` required for the admin API",
+			EnvVar: "OPBOT_HTTP_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "metrics",
+			Usage:  "Serve Prometheus metrics at /metrics on --http-addr",
+			EnvVar: "OPBOT_METRICS",
+		},
 		cli.StringFlag{
 			Name:  "log-level, l",
 			Value: "info",
@@ -126,6 +211,12 @@ func main() {
 		},
 	}
 	app.Before = func(c *cli.Context) error {
+		// "config check" reports problems with the file itself
+		if c.Args().First() != "config" {
+			if err := applyConfig(c); err != nil {
+				return cli.NewExitError(err.Error(), E_INVALID)
+			}
+		}
 		log.SetOutput(os.Stderr)
 		level, err := log.ParseLevel(c.String("log-level"))
 		if err != nil {
@@ -142,6 +233,13 @@ func main() {
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		auditCommand(),
+		dbCommand(),
+		healthCommand(),
+		configCommand(),
+	}
+
 	app.Action = entryPoint
 	app.Run(os.Args)
 }
@@ -0,0 +1,162 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Connections to one or more IRC networks. go-chat-bot's irc package only handles
+a single connection, so we set up each connection the same way it does, with a
+bot of its own, and run them all until they've QUIT.
+*/
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-chat-bot/bot"
+	"github.com/go-chat-bot/bot/irc"
+	"github.com/oddlid/opbot"
+	log "github.com/sirupsen/logrus"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+const (
+	PROTOCOL       string        = "irc"
+	RECONNECT_WAIT time.Duration = time.Minute // between attempts, if the first connect fails
+)
+
+// setupNetwork creates the connection and bot for a network, without connecting
+func setupNetwork(nc NetworkConfig, debug bool) (*opbot.Network, error) {
+	cfg := &irc.Config{
+		Server:   pickServer(nc.Servers),
+		User:     nc.User,
+		Nick:     nc.Nick,
+		RealName: nc.RealName,
+		Password: nc.Password,
+		Channels: channelSpecs(nc.Channels),
+		UseTLS:   nc.TLS.Enabled,
+		Debug:    debug,
+	}
+
+	var n *opbot.Network
+	b, ic := connection(cfg, func(target, message string) {
+		n.Privmsg(target, message) // through the send queue, set up once n is
+	})
+	tc, err := tlsConfig(nc.TLS, ic.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	ic.TLSConfig = tc
+	if err := setupSASL(nc.IRCConfig, ic); err != nil {
+		return nil, err
+	}
+
+	n = &opbot.Network{
+		Name:      nc.Name,
+		Namespace: nc.Namespace,
+		Bot:       b,
+		Config:    cfg,
+		Conn:      ic,
+		SendRate: opbot.SendRate{
+			Penalty: time.Duration(nc.SendQ.Penalty),
+			Burst:   time.Duration(nc.SendQ.Burst),
+		},
+	}
+	ic.AddCallback("001", func(e *ircevent.Event) {
+		for _, ch := range n.Channels() { // may have changed since we started, on SIGHUP
+			ic.Join(ch)
+		}
+	})
+	return n, nil
+}
+
+// connection does what irc.SetUpConn does, but for any number of connections.
+// Replies from the bot are sent with send.
+func connection(cfg *irc.Config, send func(target, message string)) (*bot.Bot, *ircevent.Connection) {
+	host, _, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		host = cfg.Server
+	}
+	ic := ircevent.IRC(cfg.Nick, cfg.User)
+	ic.Password = cfg.Password
+	ic.RealName = cfg.RealName
+	ic.UseTLS = cfg.UseTLS
+	ic.TLSConfig = &tls.Config{ServerName: host}
+	ic.VerboseCallbackHandler = cfg.Debug
+	ic.RequestCaps = append(ic.RequestCaps, "extended-join") // for the account in welcome messages
+
+	b := bot.New(
+		&bot.Handlers{
+			Response: func(target, message string, sender *bot.User) {
+				if message == "" {
+					return
+				}
+				if target == ic.GetNick() {
+					target = sender.Nick // reply to private messages in private
+				}
+				send(target, message)
+			},
+		},
+		&bot.Config{
+			Protocol: PROTOCOL,
+			Server:   cfg.Server,
+		},
+	)
+
+	received := func(e *ircevent.Event, action bool) {
+		b.MessageReceived(
+			&bot.ChannelData{
+				Protocol:  PROTOCOL,
+				Server:    cfg.Server, // lets opbot tell which network a command came from
+				Channel:   e.Arguments[0],
+				IsPrivate: e.Arguments[0] == ic.GetNick(),
+			},
+			&bot.Message{
+				Text:     e.Message(),
+				IsAction: action,
+			},
+			&bot.User{
+				ID:       e.Host,
+				Nick:     e.Nick,
+				RealName: e.User,
+			},
+		)
+	}
+	ic.AddCallback("PRIVMSG", func(e *ircevent.Event) {
+		received(e, false)
+	})
+	ic.AddCallback("CTCP_ACTION", func(e *ircevent.Event) {
+		received(e, true)
+	})
+
+	return b, ic
+}
+
+// runNetworks connects to all networks, and returns when all connections are closed after QUIT.
+// If connecting fails, it's retried until it works, or we're shutting down. Reconnecting after
+// that is taken care of by the connection itself.
+func runNetworks(nets []*opbot.Network) {
+	var wg sync.WaitGroup
+	for _, n := range nets {
+		wg.Add(1)
+		go func(n *opbot.Network) {
+			defer wg.Done()
+			for {
+				err := n.Conn.Connect(n.Config.Server)
+				if err == nil {
+					break
+				}
+				if shuttingDown() {
+					return
+				}
+				log.Errorf("%s: %s: Unable to connect: %s. Retrying in %s.", opbot.PLUGIN, n.Name, err.Error(), RECONNECT_WAIT)
+				time.Sleep(RECONNECT_WAIT)
+			}
+			log.Infof("%s: %s: Connected to %s", opbot.PLUGIN, n.Name, n.Config.Server)
+			n.Conn.Loop()
+		}(n)
+	}
+	wg.Wait()
+}
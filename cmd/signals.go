@@ -0,0 +1,157 @@
+//go:build !make
+// +build !make
+
+package main
+
+/*
+Signal handling: SIGHUP reloads the config file and the OPs file, and SIGTERM
+or SIGINT shuts down cleanly, making sure changes are saved before QUITting.
+*/
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oddlid/opbot"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	SHUTDOWN_TIMEOUT time.Duration = 5 * time.Second // how long to wait for the QUIT to go through
+)
+
+var _shutdown = struct {
+	sync.Mutex
+	started bool
+	code    int
+}{}
+
+// shutdownCode gives the exit code decided by the shutdown, or E_OK if we're not shutting down
+func shutdownCode() int {
+	_shutdown.Lock()
+	defer _shutdown.Unlock()
+	return _shutdown.code
+}
+
+// shuttingDown tells if we've got a signal to shut down
+func shuttingDown() bool {
+	_shutdown.Lock()
+	defer _shutdown.Unlock()
+	return _shutdown.started
+}
+
+func handleSignals(ctx *cli.Context, nets []*opbot.Network) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				log.Infof("%s: Got %s, reloading", opbot.PLUGIN, sig)
+				reloadAll(ctx, nets)
+				continue
+			}
+
+			_shutdown.Lock()
+			if _shutdown.started {
+				_shutdown.Unlock()
+				log.Warnf("%s: Got %s again, exiting right away", opbot.PLUGIN, sig)
+				os.Exit(E_SIGNAL)
+			}
+			_shutdown.started = true
+			_shutdown.Unlock()
+
+			log.Infof("%s: Got %s, shutting down", opbot.PLUGIN, sig)
+			code := E_OK
+			if err := opbot.Shutdown(ctx.String("quit-msg")); err != nil {
+				log.Errorf("%s: Unable to save OPs file, changes are lost: %s", opbot.PLUGIN, err.Error())
+				code = E_OPFILE
+			}
+			_shutdown.Lock()
+			_shutdown.code = code
+			_shutdown.Unlock()
+
+			// runNetworks returns when the connections are closed after QUIT, but don't wait forever
+			time.AfterFunc(SHUTDOWN_TIMEOUT, func() {
+				log.Warnf("%s: Timed out waiting for the connections to close", opbot.PLUGIN)
+				os.Exit(code)
+			})
+		}
+	}()
+}
+
+// reloadAll reloads the OPs file, and the config file, if any. From the config file, channel
+// defaults are updated, and channels added or removed are joined or parted, unless channels
+// were given with --channel. Other settings, and adding or removing networks, need a restart.
+func reloadAll(ctx *cli.Context, nets []*opbot.Network) {
+	if err := opbot.Reload(); err != nil {
+		log.Errorf("%s: Unable to reload OPs file: %s", opbot.PLUGIN, err.Error())
+	}
+
+	filename := ctx.String("config")
+	if filename == "" {
+		return
+	}
+	newConfig, err := loadConfig(filename)
+	if err == nil {
+		if errs := newConfig.Validate(); len(errs) > 0 {
+			err = errs[0]
+		}
+	}
+	if err != nil {
+		log.Errorf("%s: Not reloading config, keeping the old one: %s", opbot.PLUGIN, err.Error())
+		return
+	}
+	_config = newConfig
+	applyPolicies()
+	log.Infof("%s: Reloaded %q. Only channels and channel defaults take effect without a restart.", opbot.PLUGIN, filename)
+
+	if len(_config.Networks) == 0 {
+		if !_channelFlag && len(nets) == 1 {
+			syncChannels(nets[0], _config.Channels)
+		}
+		return
+	}
+	for _, nc := range _config.Networks {
+		found := false
+		for _, n := range nets {
+			if n.Name == nc.Name {
+				syncChannels(n, nc.Channels)
+				found = true
+			}
+		}
+		if !found {
+			log.Warnf("%s: Network %q is new in the config, and needs a restart to be connected", opbot.PLUGIN, nc.Name)
+		}
+	}
+}
+
+// syncChannels joins and parts channels on n, so it's in the given channels
+func syncChannels(n *opbot.Network, channels []ChannelConfig) {
+	wanted := make(map[string]bool)
+	for _, ch := range channels {
+		wanted[strings.ToLower(ch.Name)] = true
+	}
+	current := make(map[string]bool)
+	for _, ch := range n.Channels() {
+		name := strings.Fields(ch)[0]
+		current[strings.ToLower(name)] = true
+		if !wanted[strings.ToLower(name)] {
+			log.Infof("%s: %s: Leaving %s, as it's no longer in the config", opbot.PLUGIN, n.Name, name)
+			n.Part(name)
+		}
+	}
+	specs := channelSpecs(channels)
+	for i, ch := range channels {
+		if !current[strings.ToLower(ch.Name)] {
+			log.Infof("%s: %s: Joining %s, as it's new in the config", opbot.PLUGIN, n.Name, ch.Name)
+			n.Join(specs[i])
+		}
+	}
+	n.SetChannels(specs)
+}
@@ -0,0 +1,51 @@
+//go:build !make
+// +build !make
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-chat-bot/bot/irc"
+	"github.com/oddlid/opbot"
+	"github.com/urfave/cli"
+)
+
+func TestReloadChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(cfg *Config, flagged bool) {
+		_config, _channelFlag = cfg, flagged
+	}(_config, _channelFlag)
+
+	filename := filepath.Join(dir, "opbot.yaml")
+	yaml := "channels:\n  - name: \"#kept\"\n  - name: \"#new\"\n    key: secret\n"
+	if err := ioutil.WriteFile(filename, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", filename, "")
+	ctx := cli.NewContext(nil, set, nil)
+
+	n := &opbot.Network{Name: "test", Config: &irc.Config{Channels: []string{"#kept", "#gone"}}}
+	reloadAll(ctx, []*opbot.Network{n})
+	if want := []string{"#kept", "#new secret"}; !reflect.DeepEqual(n.Channels(), want) {
+		t.Errorf("Expected channels %q after reload, got %q", want, n.Channels())
+	}
+
+	// channels given with --channel are kept
+	_channelFlag = true
+	n.SetChannels([]string{"#flag"})
+	reloadAll(ctx, []*opbot.Network{n})
+	if want := []string{"#flag"}; !reflect.DeepEqual(n.Channels(), want) {
+		t.Errorf("Expected channels %q from --channel to be kept, got %q", want, n.Channels())
+	}
+}
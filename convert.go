@@ -0,0 +1,332 @@
+package opbot
+
+/*
+Conversion of OPData to and from other formats than the JSON used in the OPs file,
+and merging/diffing of OPData, for importing access lists from elsewhere.
+
+CSV has one row per hostmask, with the columns:
+	channel,nick,hostmask,expires,schedule
+where expires is RFC3339 or empty, and schedule is windows separated by ";",
+like "mon-fri 08:00-16:00 Europe/Oslo;sat 10:00-12:00". Channel settings, like
+the welcome message, and voice entries are not included in CSV.
+
+YAML has the same structure and field names as the JSON file.
+*/
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _csvHeader = []string{"channel", "nick", "hostmask", "expires", "schedule"}
+
+func (o *OPData) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(_csvHeader); err != nil {
+		return err
+	}
+	for _, name := range o.ChannelNames() {
+		c := o.Get(name)
+		for _, nick := range c.Nicks() {
+			expires := ""
+			if t, found := c.Expiry(nick); found {
+				expires = t.Format(time.RFC3339)
+			}
+			windows := make([]string, 0)
+			for _, win := range c.Schedule(nick) {
+				windows = append(windows, win.String())
+			}
+			masks := c.Hostmasks(nick)
+			if len(masks) == 0 {
+				masks = []string{""}
+			}
+			for _, mask := range masks {
+				err := cw.Write([]string{name, nick, mask, expires, strings.Join(windows, ";")})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func ReadCSV(r io.Reader) (*OPData, error) {
+	o := NewOPData()
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	line := 0
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line++
+		if line == 1 && strings.EqualFold(row[0], _csvHeader[0]) {
+			continue
+		}
+		if len(row) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least channel, nick and hostmask", line)
+		}
+		for len(row) < len(_csvHeader) {
+			row = append(row, "")
+		}
+
+		channel, nick, mask := row[0], row[1], row[2]
+		if channel == "" || nick == "" {
+			return nil, fmt.Errorf("line %d: channel and nick can not be empty", line)
+		}
+		c := o.Get(channel)
+		if mask == "" {
+			c.Lock()
+			if _, found := c.OPs[nick]; !found {
+				c.OPs[nick] = nil
+			}
+			c.Unlock()
+		} else {
+			c.Add(nick, mask)
+		}
+
+		if row[3] != "" {
+			t, err := time.Parse(time.RFC3339, row[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			c.SetExpiry(nick, t)
+		}
+		for _, ws := range strings.Split(row[4], ";") {
+			parts := strings.Fields(ws)
+			if len(parts) == 0 {
+				continue
+			}
+			if len(parts) < 2 || len(parts) > 3 {
+				return nil, fmt.Errorf("line %d: invalid schedule %q", line, ws)
+			}
+			parts = append(parts, "")
+			win, err := ParseWindow(parts[0], parts[1], parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			c.AddWindow(nick, win)
+		}
+	}
+	return o, nil
+}
+
+// WriteYAML converts via JSON, so the YAML has the same field names as the OPs file
+func (o *OPData) WriteYAML(w io.Writer) error {
+	o.RLock()
+	jb, err := json.Marshal(o)
+	o.RUnlock()
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(jb, &v); err != nil {
+		return err
+	}
+	yb, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yb)
+	return err
+}
+
+func ReadYAML(r io.Reader) (*OPData, error) {
+	yb, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(yb, &v); err != nil {
+		return nil, err
+	}
+	jb, err := json.Marshal(jsonable(v))
+	if err != nil {
+		return nil, err
+	}
+	o := NewOPData()
+	if err := json.Unmarshal(jb, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// jsonable converts the map[interface{}]interface{} that YAML gives us into map[string]interface{}
+func jsonable(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = jsonable(val)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = jsonable(t[i])
+		}
+	}
+	return v
+}
+
+// Channel fields that Merge combines by themselves, the rest are merged by snapshot key
+var _mergedFields = map[string]bool{
+	"wmsg":      true,
+	"idle_deop": true,
+	"ops":       true,
+	"expires":   true,
+	"schedules": true,
+	"voices":    true,
+}
+
+// Merge adds everything from src that isn't already in o. Hostmasks and schedule windows are
+// combined, while single values that differ, like the welcome message, are kept as they are in o
+// and returned as conflicts.
+func (o *OPData) Merge(src *OPData) []string {
+	conflicts := make([]string, 0)
+	for _, name := range src.ChannelNames() {
+		sc := src.Get(name)
+		dc := o.Get(name)
+
+		if sc.WelcomeMsg != "" && dc.WelcomeMsg != sc.WelcomeMsg {
+			if dc.WelcomeMsg == "" {
+				dc.Lock()
+				dc.WelcomeMsg = sc.WelcomeMsg
+				dc.Unlock()
+			} else {
+				conflicts = append(conflicts, fmt.Sprintf("%s: keeping welcome message %q, not %q", name, dc.WelcomeMsg, sc.WelcomeMsg))
+			}
+		}
+		if sd := sc.GetIdleDeop(); sd > 0 && dc.GetIdleDeop() != sd {
+			if dc.GetIdleDeop() == 0 {
+				dc.SetIdleDeop(sd)
+			} else {
+				conflicts = append(conflicts, fmt.Sprintf("%s: keeping idle deop %s, not %s", name, dc.GetIdleDeop(), sd))
+			}
+		}
+
+		for _, nick := range sc.Nicks() {
+			isNew := !dc.Has(nick)
+			masks := sc.Hostmasks(nick)
+			if len(masks) == 0 && isNew {
+				dc.Lock()
+				dc.OPs[nick] = nil
+				dc.Unlock()
+			}
+			for _, mask := range masks {
+				dc.Add(nick, mask)
+			}
+			for _, win := range sc.Schedule(nick) {
+				dc.AddWindow(nick, win)
+			}
+			st, sfound := sc.Expiry(nick)
+			dt, dfound := dc.Expiry(nick)
+			if sfound && isNew {
+				dc.SetExpiry(nick, st)
+			} else if sfound && !dfound {
+				conflicts = append(conflicts, fmt.Sprintf("%s: keeping %q permanent, not expiring at %s", name, nick, st.Format(time.RFC3339)))
+			} else if sfound && !st.Equal(dt) {
+				conflicts = append(conflicts, fmt.Sprintf("%s: keeping expiry for %q at %s, not %s", name, nick, dt.Format(time.RFC3339), st.Format(time.RFC3339)))
+			}
+		}
+		for _, nick := range sc.VoiceNicks() {
+			for _, mask := range sc.VoiceHostmasks(nick) {
+				dc.AddVoice(nick, mask)
+			}
+		}
+
+		// everything else, like "flood" or "greetings/<nick>", is taken from src if not set in o
+		ssnap, dsnap := sc.snapshot(), dc.snapshot()
+		keys := make([]string, 0, len(ssnap))
+		for key := range ssnap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		take := make(map[string]string)
+		for _, key := range keys {
+			sval, dval := ssnap[key], dsnap[key]
+			if _mergedFields[strings.SplitN(key, "/", 2)[0]] || emptyJSON(key, sval) || sval == dval {
+				continue
+			}
+			if emptyJSON(key, dval) {
+				take[key] = sval
+			} else {
+				conflicts = append(conflicts, fmt.Sprintf("%s: keeping %s %s, not %s", name, key, dval, sval))
+			}
+		}
+		if len(take) > 0 {
+			if err := dc.apply(take); err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s: unable to merge %v: %s", name, take, err))
+			}
+		}
+	}
+	return conflicts
+}
+
+// Diff describes what changes going from o to n, one line per changed value
+func (o *OPData) Diff(n *OPData) []string {
+	names := make(map[string]bool)
+	for _, name := range o.ChannelNames() {
+		names[name] = true
+	}
+	for _, name := range n.ChannelNames() {
+		names[name] = true
+	}
+
+	snap := func(od *OPData, name string) map[string]string {
+		od.RLock()
+		c, found := od.Channels[name]
+		od.RUnlock()
+		if !found {
+			return map[string]string{}
+		}
+		return c.snapshot()
+	}
+
+	lines := make([]string, 0)
+	for name := range names {
+		for _, ch := range diff(snap(o, name), snap(n, name)) {
+			before, after := emptyJSON(ch.Key, ch.Before), emptyJSON(ch.Key, ch.After)
+			switch {
+			case before && after:
+				continue
+			case before:
+				lines = append(lines, fmt.Sprintf("+ %s %s: %s", name, ch.Key, ch.After))
+			case after:
+				lines = append(lines, fmt.Sprintf("- %s %s: %s", name, ch.Key, ch.Before))
+			default:
+				lines = append(lines, fmt.Sprintf("~ %s %s: %s -> %s", name, ch.Key, ch.Before, ch.After))
+			}
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+	return lines
+}
+
+// emptyJSON tells if a JSON value from a snapshot is missing or a zero value.
+// An OP entry without hostmasks is null, but still there.
+func emptyJSON(key, v string) bool {
+	if strings.HasPrefix(key, "ops/") {
+		return v == ""
+	}
+	switch v {
+	case "", `""`, "null", "0", `"0s"`, "{}", "[]":
+		return true
+	}
+	return false
+}
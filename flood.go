@@ -0,0 +1,425 @@
+package opbot
+
+/*
+Join-flood and clone detection. Each channel may have limits for how many
+joins it takes within a time window to be a flood, and how many nicks from
+the same host it takes to be clones. When a limit is reached, the bot does
+the actions given for the channel: sets a channel mode like +i or +r, bans
+*!*@host for the hosts involved, and/or alerts the OPs present with a NOTICE.
+
+Modes and bans set this way are kept in the OPs file with when they should be
+lifted, so they're lifted by the scheduler even if the bot restarts meanwhile,
+or is disconnected or without OP when the time is up, in which case they're
+lifted once it's back.
+While a flood is going on, more joins just get the hosts banned (if "ban" is
+one of the actions), and don't set things off again.
+
+Only nicks that don't get OP on join are counted.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+const (
+	FLOOD_BAN      string        = "ban"
+	FLOOD_ALERT    string        = "alert"
+	DEF_FLOOD_LIFT time.Duration = 10 * time.Minute
+)
+
+// FloodLimits are the join-flood and clone limits for a channel, and what to do when they're reached
+type FloodLimits struct {
+	Joins   int      `json:"joins,omitempty"`   // joins within Window that make a flood, 0 to not check
+	Window  Duration `json:"window,omitempty"`  // how far back to count joins
+	Clones  int      `json:"clones,omitempty"`  // nicks from the same host that make clones, 0 to not check
+	Actions []string `json:"actions,omitempty"` // "ban", "alert", and/or channel modes to set, like "+i"
+	Lift    Duration `json:"lift,omitempty"`    // when to lift modes and bans, 0 for DEF_FLOOD_LIFT
+}
+
+// TimedMode is a channel mode the bot has set, that should be unset at a given time
+type TimedMode struct {
+	Mode    string    `json:"mode"` // as set, like "+i" or "+b"
+	Param   string    `json:"param,omitempty"`
+	Until   time.Time `json:"until"`
+	Network string    `json:"network,omitempty"` // where it was set, "" for all networks using the channel
+}
+
+type joinRecord struct {
+	at   time.Time
+	host string
+}
+
+// floodState is what each network keeps track of per channel to detect floods
+type floodState struct {
+	sync.Mutex
+	joins map[string][]joinRecord // channel -> recent joins
+	until map[string]time.Time    // channel, or "channel host" for clones -> when the current flood is considered over
+}
+
+func newFloodState() *floodState {
+	return &floodState{
+		joins: make(map[string][]joinRecord),
+		until: make(map[string]time.Time),
+	}
+}
+
+// reset forgets the joins and floods going on in channel, clones included
+func (fs *floodState) reset(channel string) {
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.joins, channel)
+	for key := range fs.until {
+		if key == channel || strings.HasPrefix(key, channel+" ") {
+			delete(fs.until, key)
+		}
+	}
+}
+
+// Validate checks that the limits make sense
+func (f *FloodLimits) Validate() error {
+	if f.Joins < 0 || f.Clones < 0 || f.Window < 0 || f.Lift < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if f.Joins > 0 && f.Window == 0 {
+		return fmt.Errorf("joins needs a window")
+	}
+	for _, a := range f.Actions {
+		if !validFloodAction(a) {
+			return fmt.Errorf("invalid action %q, expected %s, %s or a channel mode like +i", a, FLOOD_BAN, FLOOD_ALERT)
+		}
+	}
+	return nil
+}
+
+func (f *FloodLimits) lift() time.Duration {
+	if f.Lift > 0 {
+		return time.Duration(f.Lift)
+	}
+	return DEF_FLOOD_LIFT
+}
+
+func (f *FloodLimits) has(action string) bool {
+	for _, a := range f.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FloodLimits) String() string {
+	parts := make([]string, 0, 4)
+	if f.Joins > 0 {
+		parts = append(parts, fmt.Sprintf("joins %d/%s", f.Joins, fmtDuration(time.Duration(f.Window))))
+	}
+	if f.Clones > 0 {
+		parts = append(parts, fmt.Sprintf("clones %d", f.Clones))
+	}
+	if len(parts) == 0 {
+		return "off"
+	}
+	actions := strings.Join(f.Actions, ",")
+	if actions == "" {
+		actions = "none"
+	}
+	parts = append(parts, "actions "+actions, "lift "+fmtDuration(f.lift()))
+	return strings.Join(parts, ", ")
+}
+
+// validFloodAction tells if a is "ban", "alert", or a channel mode without parameter to set
+func validFloodAction(a string) bool {
+	if a == FLOOD_BAN || a == FLOOD_ALERT {
+		return true
+	}
+	return len(a) == 2 && a[0] == '+' && isLetter(a[1]) && !strings.ContainsRune(paramModes+"l", rune(a[1]))
+}
+
+func isLetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// hostOf gives the host part of a nick!user@host mask
+func hostOf(mask string) string {
+	if i := strings.LastIndex(mask, "@"); i > -1 {
+		return mask[i+1:]
+	}
+	return ""
+}
+
+// dueModes gives copies of the timed modes that should be lifted at the given time
+func (c *Channel) dueModes(now time.Time) []TimedMode {
+	c.RLock()
+	defer c.RUnlock()
+	due := make([]TimedMode, 0)
+	for _, tm := range c.Lifts {
+		if !now.Before(tm.Until) {
+			due = append(due, *tm)
+		}
+	}
+	return due
+}
+
+// dropLifted removes timed modes that have been lifted, unless they were extended meanwhile. Caller must hold the lock.
+func (c *Channel) dropLifted(lifted []TimedMode, now time.Time) {
+	keep := make([]*TimedMode, 0, len(c.Lifts))
+	for _, tm := range c.Lifts {
+		done := false
+		for _, l := range lifted {
+			if tm.Mode == l.Mode && tm.Param == l.Param && tm.Network == l.Network && !now.Before(tm.Until) {
+				done = true
+			}
+		}
+		if !done {
+			keep = append(keep, tm)
+		}
+	}
+	if len(keep) == 0 {
+		keep = nil
+	}
+	c.Lifts = keep
+}
+
+// HasDueModes tells if any timed modes should be lifted at the given time
+func (c *Channel) HasDueModes(now time.Time) bool {
+	c.RLock()
+	defer c.RUnlock()
+	for _, tm := range c.Lifts {
+		if !now.Before(tm.Until) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTimedMode adds or extends a timed mode. Caller must hold the lock.
+func (c *Channel) addTimedMode(tm *TimedMode) {
+	for _, existing := range c.Lifts {
+		if existing.Mode == tm.Mode && existing.Param == tm.Param && existing.Network == tm.Network {
+			if tm.Until.After(existing.Until) {
+				existing.Until = tm.Until
+			}
+			return
+		}
+	}
+	c.Lifts = append(c.Lifts, tm)
+}
+
+// floodLimits gives the flood limits for channel, from the OPs file or the policy, or nil if there are none
+func floodLimits(channel string, c *Channel) *FloodLimits {
+	c.RLock()
+	f := c.Flood
+	c.RUnlock()
+	if f != nil {
+		return f
+	}
+	return policy(channel).Flood
+}
+
+// checkJoinFlood records a join by a nick that doesn't get OP, and acts if it makes
+// a flood or clones. Returns true if the channel is being flooded.
+func (n *Network) checkJoinFlood(e *ircevent.Event, c *Channel) bool {
+	const fn string = "checkJoinFlood()"
+
+	channel := e.Arguments[0]
+	f := floodLimits(n.key(channel), c)
+	if f == nil || (f.Joins == 0 && f.Clones == 0) {
+		return false
+	}
+	now := time.Now()
+	host := hostOf(e.Source)
+
+	n.floods.Lock()
+	joins := append(n.floods.joins[channel], joinRecord{at: now, host: host})
+	start := 0
+	for start < len(joins) && now.Sub(joins[start].at) > time.Duration(f.Window) {
+		start++
+	}
+	joins = joins[start:]
+	n.floods.joins[channel] = joins
+
+	ongoing := now.Before(n.floods.until[channel])
+	flooded := f.Joins > 0 && len(joins) >= f.Joins
+	var hosts []string
+	if flooded && !ongoing {
+		n.floods.until[channel] = now.Add(f.lift())
+		seen := make(map[string]bool)
+		for _, j := range joins {
+			if !seen[j.host] {
+				seen[j.host] = true
+				hosts = append(hosts, j.host)
+			}
+		}
+	}
+	n.floods.Unlock()
+
+	if ongoing {
+		devdbg("%s: %s: Flood going on in %s, banning host of %q", PLUGIN, fn, channel, e.Nick)
+		if f.has(FLOOD_BAN) {
+			n.floodBan(channel, f, []string{host})
+		}
+		return true
+	}
+	if flooded {
+		n.floodActions(channel, f, "joins", fmt.Sprintf("Join flood, %d joins in %s", len(joins), fmtDuration(time.Duration(f.Window))), hosts)
+		return true
+	}
+
+	if f.Clones == 0 || host == "" {
+		return false
+	}
+	clones := 0
+	for _, m := range n.roster.Members(channel) {
+		if hostOf(m.Mask) == host && !m.OP {
+			clones++
+		}
+	}
+	if clones < f.Clones {
+		return false
+	}
+	n.floods.Lock()
+	ongoing = now.Before(n.floods.until[channel+" "+host])
+	if !ongoing {
+		n.floods.until[channel+" "+host] = now.Add(f.lift())
+	}
+	n.floods.Unlock()
+	if !ongoing {
+		n.floodActions(channel, f, "clones", fmt.Sprintf("%d clones from %s", clones, host), []string{host})
+	}
+	return true
+}
+
+// floodActions does what the channel's flood limits say, for the given hosts.
+// kind is "joins" or "clones", for metrics.
+func (n *Network) floodActions(channel string, f *FloodLimits, kind, reason string, hosts []string) {
+	log.Warnf("%s: %s: %s in %s", PLUGIN, n.Name, reason, channel)
+	_mFloods.WithLabelValues(kind).Inc()
+
+	until := time.Now().Add(f.lift())
+	modes := make([]*TimedMode, 0)
+	for _, a := range f.Actions {
+		switch a {
+		case FLOOD_ALERT:
+			n.Notice("@"+channel, fmt.Sprintf("%s: %s in %s, lifting measures in %s", PLUGIN, reason, channel, fmtDuration(f.lift())))
+		case FLOOD_BAN:
+			// below, along with bans for later joins
+		default:
+			n.mode(channel, a)
+			modes = append(modes, &TimedMode{Mode: a, Until: until, Network: n.Name})
+		}
+	}
+	if len(modes) > 0 {
+		n.timedModes(channel, modes)
+	}
+	if f.has(FLOOD_BAN) {
+		n.floodBan(channel, f, hosts)
+	}
+}
+
+// floodBan bans *!*@host for each host, to be lifted with the other flood measures
+func (n *Network) floodBan(channel string, f *FloodLimits, hosts []string) {
+	until := time.Now().Add(f.lift())
+	modes := make([]*TimedMode, 0, len(hosts))
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		mask := "*!*@" + host
+		n.mode(channel, "+b", mask)
+		modes = append(modes, &TimedMode{Mode: "+b", Param: mask, Until: until, Network: n.Name})
+	}
+	if len(modes) > 0 {
+		n.timedModes(channel, modes)
+	}
+}
+
+// timedModes remembers modes set in channel, for the scheduler to lift
+func (n *Network) timedModes(channel string, modes []*TimedMode) {
+	changeLifts(n.key(channel), func(c *Channel) {
+		c.Lock()
+		for _, tm := range modes {
+			c.addTimedMode(tm)
+		}
+		c.Unlock()
+	})
+}
+
+// liftModes unsets timed modes whose time is up. A mode is only lifted, and forgotten, once
+// the bot is connected and has OP in the channel on every network it's to be lifted on, so
+// it's tried again at the next tick until then.
+func liftModes(now time.Time) {
+	for _, channel := range ops().ChannelNames() {
+		c := ops().Get(channel)
+		if !c.HasDueModes(now) {
+			continue
+		}
+		nets, name := networksFor(channel)
+		lifted := make([]TimedMode, 0)
+		for _, tm := range c.dueModes(now) {
+			on := liftOn(nets, tm)
+			ready := len(on) > 0
+			for _, n := range on {
+				if !n.opIn(name) {
+					devdbg("%s: %s: Not OP in %s, unable to lift %s %s yet", PLUGIN, n.Name, name, tm.Mode, tm.Param)
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+			unset := "-" + strings.TrimPrefix(tm.Mode, "+")
+			for _, n := range on {
+				log.Infof("%s: %s: Lifting %s %s in %s", PLUGIN, n.Name, tm.Mode, tm.Param, name)
+				if tm.Param == "" {
+					n.mode(name, unset)
+				} else {
+					n.mode(name, unset, tm.Param)
+				}
+			}
+			lifted = append(lifted, tm)
+		}
+		if len(lifted) > 0 {
+			changeLifts(channel, func(c *Channel) {
+				c.Lock()
+				c.dropLifted(lifted, now)
+				c.Unlock()
+			})
+		}
+	}
+}
+
+// liftOn gives the networks among nets that tm should be lifted on. If it was set on a
+// network that's no longer there, maybe renamed since, it's lifted on all of them.
+func liftOn(nets []*Network, tm TimedMode) []*Network {
+	if tm.Network == "" {
+		return nets
+	}
+	for _, n := range nets {
+		if n.Name == tm.Network {
+			return []*Network{n}
+		}
+	}
+	return nets
+}
+
+// parseFloodJoins parses the number of joins and window for "!op flood set joins <n> <window>"
+func parseFloodJoins(joins, window string) (int, time.Duration, error) {
+	j, err := strconv.Atoi(joins)
+	if err != nil || j < 0 {
+		return 0, 0, fmt.Errorf("invalid number of joins %q", joins)
+	}
+	if j == 0 {
+		return 0, 0, nil
+	}
+	w, err := parseDuration(window)
+	if err != nil || w <= 0 {
+		return 0, 0, fmt.Errorf("invalid window %q, use e.g. 30s or 1m", window)
+	}
+	return j, w, nil
+}
@@ -0,0 +1,113 @@
+package opbot
+
+/*
+Health and readiness, for container orchestration.
+
+The bot is healthy when it's connected to all its networks, and ready when it's
+also joined all configured channels and the OPs file loaded without errors. Whether the bot
+has OP in each channel is reported, but doesn't affect readiness, as the bot
+can't give itself OP.
+*/
+
+import (
+	"net/http"
+	"strings"
+)
+
+type ChannelStatus struct {
+	Network string `json:"network"`
+	Name    string `json:"name"`
+	Joined  bool   `json:"joined"`
+	OP      bool   `json:"op"`
+}
+
+type NetworkStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+}
+
+type Health struct {
+	Connected bool            `json:"connected"` // to all networks
+	DBLoaded  bool            `json:"db_loaded"`
+	DBError   string          `json:"db_error,omitempty"`
+	Networks  []NetworkStatus `json:"networks"`
+	Channels  []ChannelStatus `json:"channels"`
+}
+
+// Status returns the current health of the bot
+func Status() *Health {
+	h := &Health{
+		Networks: make([]NetworkStatus, 0, len(_networks)),
+		Channels: make([]ChannelStatus, 0),
+	}
+	if len(_networks) == 0 {
+		return h
+	}
+
+	if ops := ops(); ops != nil {
+		h.DBLoaded = true
+		if err := ops.LoadError(); err != nil {
+			h.DBLoaded = false
+			h.DBError = err.Error()
+		}
+	}
+
+	h.Connected = true
+	for _, n := range _networks {
+		connected := n.Conn.Connected()
+		h.Networks = append(h.Networks, NetworkStatus{Name: n.Name, Connected: connected})
+		h.Connected = h.Connected && connected
+
+		me := n.Conn.GetNick()
+		for _, ch := range n.Channels() {
+			fields := strings.Fields(ch) // may be "#chan key"
+			if len(fields) == 0 {
+				continue
+			}
+			cs := ChannelStatus{Network: n.Name, Name: fields[0]}
+			if m := n.roster.Get(cs.Name, me); m != nil && connected {
+				cs.Joined = true
+				cs.OP = m.OP
+			}
+			h.Channels = append(h.Channels, cs)
+		}
+	}
+	return h
+}
+
+func (h *Health) Healthy() bool {
+	return h.Connected
+}
+
+func (h *Health) Ready() bool {
+	if !h.Connected || !h.DBLoaded {
+		return false
+	}
+	for _, cs := range h.Channels {
+		if !cs.Joined {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthHandler serves the status as JSON, with 200 OK if healthy, or 503 if not. Usually at /healthz.
+func HealthHandler() http.Handler {
+	return statusHandler((*Health).Healthy)
+}
+
+// ReadyHandler serves the status as JSON, with 200 OK if ready, or 503 if not. Usually at /readyz.
+func ReadyHandler() http.Handler {
+	return statusHandler((*Health).Ready)
+}
+
+func statusHandler(ok func(h *Health) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := Status()
+		status := http.StatusOK
+		if !ok(h) {
+			status = http.StatusServiceUnavailable
+		}
+		apiReply(w, status, h)
+	})
+}
@@ -0,0 +1,259 @@
+package opbot
+
+/*
+Importers for access lists from other bots and services, for migrating channels.
+
+Eggdrop userfiles (the .user file) are read for handles, their --HOSTS and their
+global and channel flags. Handles become nicks. Users with the n, m or o flag,
+and not d, get OP. Users with v or g, and not q, get voice. Bots are skipped.
+
+ChanServ listings are read as captured from an IRC client, one entry per line,
+with or without a "-ChanServ-" prefix. These are understood:
+	Atheme FLAGS:       1  nick  +AOiortv
+	Atheme ACCESS LIST: 1  nick  AOP
+	Anope ACCESS LIST:  1  5     nick
+Flags o or O, roles FOUNDER, SOP and AOP, and levels >= CS_AOP_LEVEL give OP.
+Flags v, V, h or H, roles HOP and VOP, and levels >= CS_VOP_LEVEL give voice.
+Entries that are hostmasks are used as is. Entries that are account names have
+no hostmask to match on, so unless a mask template is given, they're added
+without hostmasks, and must be given some before they'll get OP.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CS_AOP_LEVEL int = 5 // Anope default level for AUTOOP
+	CS_VOP_LEVEL int = 3 // Anope default level for AUTOVOICE
+)
+
+var _csPrefix = regexp.MustCompile(`(?i)^.*?-chanserv(\([^)]*\))?-\s*`)
+
+type eggUser struct {
+	handle string
+	flags  string            // global flags
+	chans  map[string]string // channel -> channel flags
+	hosts  []string
+}
+
+// ReadEggdrop reads an Eggdrop userfile. If channel is not empty, only that channel is imported.
+func ReadEggdrop(r io.Reader, channel string) (*OPData, error) {
+	users := make([]*eggUser, 0)
+	channels := make(map[string]bool)
+	var u *eggUser
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+
+		switch {
+		case strings.HasPrefix(text, "--"):
+			if u != nil && fields[0] == "--HOSTS" && len(fields) > 1 {
+				u.hosts = append(u.hosts, fields[1])
+			}
+		case strings.HasPrefix(text, "! "):
+			// ! #channel laston flags [info]
+			if u == nil || len(fields) < 4 {
+				continue
+			}
+			u.chans[fields[1]] = strings.SplitN(fields[3], "|", 2)[0]
+			channels[fields[1]] = true
+		case strings.HasPrefix(text, "::"):
+			// ::#channel bans
+			channels[strings.TrimPrefix(fields[0], "::")] = true
+		case strings.ContainsAny(text[:1], "#-*&$%@+: \t"):
+			// header, bans, exempts, invites and so on
+			continue
+		default:
+			// handle - flags
+			if len(fields) < 3 || fields[1] != "-" {
+				log.Warnf("%s: Skipping line %d, expected \"handle - flags\", got %q", PLUGIN, line, text)
+				u = nil
+				continue
+			}
+			u = &eggUser{
+				handle: fields[0],
+				flags:  strings.SplitN(fields[2], "|", 2)[0],
+				chans:  make(map[string]string),
+			}
+			users = append(users, u)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users found, is this an Eggdrop userfile?")
+	}
+
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		if channel == "" || strings.EqualFold(name, channel) {
+			names = append(names, name)
+		}
+	}
+	if channel != "" && len(names) == 0 {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+
+	o := NewOPData()
+	for _, u := range users {
+		if strings.Contains(u.flags, "b") {
+			log.Debugf("%s: Skipping bot %q", PLUGIN, u.handle)
+			continue
+		}
+		hosts := make([]string, 0, len(u.hosts))
+		for _, h := range u.hosts {
+			if strings.HasPrefix(h, "-telnet!") {
+				continue
+			}
+			if !ValidMask(h) {
+				log.Warnf("%s: Skipping invalid hostmask %q for %q", PLUGIN, h, u.handle)
+				continue
+			}
+			hosts = append(hosts, h)
+		}
+
+		for _, name := range names {
+			flags := u.flags + u.chans[name]
+			op := strings.ContainsAny(flags, "nmo") && !strings.Contains(flags, "d")
+			voice := !op && strings.ContainsAny(flags, "vg") && !strings.Contains(flags, "q")
+			if !op && !voice {
+				continue
+			}
+			if len(hosts) == 0 {
+				log.Warnf("%s: Skipping %q in %s, no usable hostmasks", PLUGIN, u.handle, name)
+				continue
+			}
+			c := o.Get(name)
+			for _, h := range hosts {
+				if op {
+					c.Add(u.handle, h)
+				} else {
+					c.AddVoice(u.handle, h)
+				}
+			}
+		}
+	}
+	return o, nil
+}
+
+// ReadChanServ reads a captured ChanServ access or flags listing. If channel is empty, it's
+// taken from the listing. Account entries get the hostmask from maskTmpl, with every "%s"
+// replaced by the account name, or no hostmask if maskTmpl is empty.
+func ReadChanServ(r io.Reader, channel, maskTmpl string) (*OPData, error) {
+	type entry struct {
+		nick, mask string
+		op         bool
+	}
+	entries := make([]entry, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := _csPrefix.ReplaceAllString(strings.TrimSpace(scanner.Text()), "")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			// Not an entry, but might tell which channel this is, like "End of #chan FLAGS listing."
+			if channel == "" {
+				for _, f := range fields {
+					if strings.HasPrefix(f, "#") {
+						channel = strings.TrimRight(f, ":.,")
+						break
+					}
+				}
+			}
+			continue
+		}
+		if len(fields) < 3 {
+			continue
+		}
+
+		var who string
+		var op, voice bool
+		if lvl, err := strconv.Atoi(fields[1]); err == nil {
+			who = fields[2]
+			op = lvl >= CS_AOP_LEVEL
+			voice = lvl >= CS_VOP_LEVEL
+		} else if strings.HasPrefix(fields[2], "+") {
+			who = fields[1]
+			op = strings.ContainsAny(fields[2], "oO")
+			voice = strings.ContainsAny(fields[2], "vVhH")
+		} else {
+			who = fields[1]
+			switch strings.ToUpper(fields[2]) {
+			case "FOUNDER", "SOP", "AOP":
+				op = true
+			case "HOP", "VOP":
+				voice = true
+			default:
+				log.Warnf("%s: Skipping %q with unknown role %q", PLUGIN, who, fields[2])
+			}
+		}
+		if !op && !voice {
+			continue
+		}
+
+		e := entry{op: op}
+		if strings.ContainsAny(who, "!@") {
+			e.mask = who
+			e.nick = strings.SplitN(who, "!", 2)[0]
+			if strings.ContainsAny(e.nick, "*?@") || !ValidMask(e.mask) {
+				log.Warnf("%s: Skipping %q, need a hostmask with a nick to import", PLUGIN, who)
+				continue
+			}
+		} else {
+			e.nick = who
+			if maskTmpl != "" {
+				e.mask = strings.Replace(maskTmpl, "%s", who, -1)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if channel == "" {
+		return nil, fmt.Errorf("unable to tell which channel the listing is for, please give it")
+	}
+
+	o := NewOPData()
+	c := o.Get(channel)
+	for _, e := range entries {
+		switch {
+		case e.op && e.mask != "":
+			c.Add(e.nick, e.mask)
+		case e.op:
+			log.Warnf("%s: %q has no hostmask, and won't get OP until given one", PLUGIN, e.nick)
+			c.Lock()
+			if _, found := c.OPs[e.nick]; !found {
+				c.OPs[e.nick] = nil
+			}
+			c.Unlock()
+		case e.mask != "":
+			c.AddVoice(e.nick, e.mask)
+		default:
+			log.Warnf("%s: Skipping voice for %q, no hostmask", PLUGIN, e.nick)
+		}
+	}
+	return o, nil
+}
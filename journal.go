@@ -0,0 +1,377 @@
+package opbot
+
+/*
+The journal records every change to a channel as a change set, so it can be
+undone with "!op undo". Each change set holds the before and after values of
+the parts of the channel that changed, as JSON. Values for single nicks, like
+"ops/Oddlid", are kept separate from each other, so undoing an older change
+set doesn't revert changes made to other nicks since then.
+
+The journal is only kept in memory, and is limited to the last JOURNAL_SIZE change sets.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	JOURNAL_SIZE int = 50
+)
+
+// Channel fields that are maps keyed by nick, and so are journaled per nick
+var _perNick = map[string]bool{
+	"ops":       true,
+	"expires":   true,
+	"schedules": true,
+	"voices":    true,
+	"greetings": true,
+}
+
+// origin tells who made a change, and by which command
+type origin struct {
+	Caller  string
+	Command string
+}
+
+type Change struct {
+	Key    string `json:"key"`              // e.g. "wmsg" or "ops/Oddlid"
+	Before string `json:"before,omitempty"` // JSON value, empty if the key didn't exist
+	After  string `json:"after,omitempty"`  // JSON value, empty if the key was removed
+}
+
+type ChangeSet struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Caller  string    `json:"caller"`
+	Command string    `json:"command"`
+	Changes []Change  `json:"changes"`
+	Undone  bool      `json:"undone"`
+}
+
+// _changeMu serializes changes, and is held forever once we're shutting down
+var _changeMu sync.Mutex
+
+var _journal = struct {
+	sync.Mutex
+	sets   []*ChangeSet
+	nextID int
+}{nextID: 1}
+
+func (cs *ChangeSet) String() string {
+	s := fmt.Sprintf("#%d %s %s: %s", cs.ID, cs.Time.Format("2006-01-02 15:04"), cs.Caller, cs.Command)
+	if cs.Undone {
+		s += " (undone)"
+	}
+	return s
+}
+
+// Nicks returns the nicks affected by the change set
+func (cs *ChangeSet) Nicks() []string {
+	seen := make(map[string]bool)
+	nicks := make([]string, 0)
+	for _, ch := range cs.Changes {
+		parts := strings.SplitN(ch.Key, "/", 2)
+		if len(parts) == 2 && !seen[parts[1]] {
+			seen[parts[1]] = true
+			nicks = append(nicks, parts[1])
+		}
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// snapshot flattens the channel into keys like "wmsg" and "ops/<nick>", with JSON values
+func (c *Channel) snapshot() map[string]string {
+	c.RLock()
+	jb, err := json.Marshal(c)
+	c.RUnlock()
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jb, &fields); err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	snap := make(map[string]string)
+	for field, val := range fields {
+		if !_perNick[field] {
+			snap[field] = string(val)
+			continue
+		}
+		var nicks map[string]json.RawMessage
+		if err := json.Unmarshal(val, &nicks); err != nil {
+			log.Error(err)
+			continue
+		}
+		for nick, nval := range nicks {
+			snap[field+"/"+nick] = string(nval)
+		}
+	}
+	return snap
+}
+
+// apply sets each key to the given JSON value, or removes it if the value is empty
+func (c *Channel) apply(values map[string]string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	jb, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jb, &fields); err != nil {
+		return err
+	}
+
+	for key, val := range values {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) == 1 {
+			if val == "" {
+				delete(fields, key)
+			} else {
+				fields[key] = json.RawMessage(val)
+			}
+			continue
+		}
+
+		nicks := make(map[string]json.RawMessage)
+		if fv, found := fields[parts[0]]; found {
+			if err := json.Unmarshal(fv, &nicks); err != nil {
+				return err
+			}
+		}
+		if val == "" {
+			delete(nicks, parts[1])
+		} else {
+			nicks[parts[1]] = json.RawMessage(val)
+		}
+		nb, err := json.Marshal(nicks)
+		if err != nil {
+			return err
+		}
+		fields[parts[0]] = nb
+	}
+
+	jb, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	n := newChannel()
+	if err := json.Unmarshal(jb, n); err != nil {
+		return err
+	}
+	c.replace(n)
+	return nil
+}
+
+// replace sets all fields of c to the values of n, except the embedded mutex. Caller must hold the lock.
+func (c *Channel) replace(n *Channel) {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(n).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).Anonymous {
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+	}
+}
+
+// diff returns the keys that differ between two snapshots
+func diff(before, after map[string]string) []Change {
+	changes := make([]Change, 0)
+	for key, bval := range before {
+		if aval := after[key]; aval != bval {
+			changes = append(changes, Change{Key: key, Before: bval, After: aval})
+		}
+	}
+	for key, aval := range after {
+		if _, found := before[key]; !found {
+			changes = append(changes, Change{Key: key, After: aval})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// change runs fn on the channel, records what changed in the journal and saves the OPs file.
+// Returns nil if fn didn't change anything.
+func change(channel string, by origin, fn func(c *Channel)) (*ChangeSet, error) {
+	_changeMu.Lock()
+	defer _changeMu.Unlock()
+
+	reloadIfChanged()
+	c := _ops.Get(channel)
+	before := c.snapshot()
+	fn(c)
+	changes := diff(before, c.snapshot())
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	cs := &ChangeSet{
+		Time:    time.Now(),
+		Channel: channel,
+		Caller:  by.Caller,
+		Command: by.Command,
+		Changes: changes,
+	}
+	record(cs)
+
+	err := _ops.SaveFile(_opfile)
+	if err != nil {
+		log.Error(err)
+	}
+	return cs, err
+}
+
+// changeLifts runs fn on the channel to change its timed modes, and saves the OPs file.
+// Unlike change, nothing is journalled: timed modes are the bot's own bookkeeping, and
+// a bare undo should undo the last edit by a user, and not a flood ban.
+func changeLifts(channel string, fn func(c *Channel)) error {
+	_changeMu.Lock()
+	defer _changeMu.Unlock()
+
+	reloadIfChanged()
+	fn(_ops.Get(channel))
+	err := _ops.SaveFile(_opfile)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func record(cs *ChangeSet) {
+	_journal.Lock()
+	defer _journal.Unlock()
+
+	cs.ID = _journal.nextID
+	_journal.nextID++
+	_journal.sets = append(_journal.sets, cs)
+	if len(_journal.sets) > JOURNAL_SIZE {
+		_journal.sets = _journal.sets[len(_journal.sets)-JOURNAL_SIZE:]
+	}
+}
+
+// changeSets returns the change sets for channel, newest first
+func changeSets(channel string) []*ChangeSet {
+	_journal.Lock()
+	defer _journal.Unlock()
+
+	sets := make([]*ChangeSet, 0)
+	for i := len(_journal.sets) - 1; i >= 0; i-- {
+		if _journal.sets[i].Channel == channel {
+			sets = append(sets, _journal.sets[i])
+		}
+	}
+	return sets
+}
+
+// undo reverts a change set for channel. With an empty id, the latest change set not already undone is reverted.
+func undo(channel string, by origin, id string) (string, error) {
+	sets := changeSets(channel)
+
+	if match(id, LS) {
+		if len(sets) == 0 {
+			return fmt.Sprintf("%s: No changes to undo for %s", PLUGIN, channel), nil
+		}
+		lines := make([]string, 0, 5)
+		for i := 0; i < len(sets) && i < 5; i++ {
+			lines = append(lines, sets[i].String())
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	var target *ChangeSet
+	if id == "" {
+		for _, cs := range sets {
+			if !cs.Undone {
+				target = cs
+				break
+			}
+		}
+		if target == nil {
+			return fmt.Sprintf("%s: No changes to undo for %s", PLUGIN, channel), nil
+		}
+	} else {
+		var n int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(id, "#"), "%d", &n); err != nil {
+			return fmt.Sprintf("%s: Usage: !op %s [id|ls]", PLUGIN, strings.ToLower(UNDO)), nil
+		}
+		for _, cs := range sets {
+			if cs.ID == n {
+				target = cs
+				break
+			}
+		}
+		if target == nil {
+			return fmt.Sprintf("%s: No change #%d for %s", PLUGIN, n, channel), nil
+		}
+		if target.Undone {
+			return fmt.Sprintf("%s: Change #%d is already undone", PLUGIN, n), nil
+		}
+	}
+
+	// Don't silently throw away anything changed after the target
+	current := ops().Get(channel).snapshot()
+	values := make(map[string]string)
+	for _, ch := range target.Changes {
+		if current[ch.Key] != ch.After {
+			return fmt.Sprintf("%s: Cannot undo #%d, %q has been changed since. Undo the later change first.", PLUGIN, target.ID, ch.Key), nil
+		}
+		values[ch.Key] = ch.Before
+	}
+
+	var aerr error
+	by.Command = fmt.Sprintf("undo #%d (%s)", target.ID, target.Command)
+	_, err := change(channel, by, func(c *Channel) {
+		aerr = c.apply(values)
+	})
+	if aerr != nil {
+		log.Error(aerr)
+		return fmt.Sprintf("%s: Unable to undo #%d", PLUGIN, target.ID), aerr
+	}
+
+	_journal.Lock()
+	target.Undone = true
+	_journal.Unlock()
+
+	syncModes(channel, target.Nicks())
+
+	return fmt.Sprintf("%s: Undid #%d: %s", PLUGIN, target.ID, target.Command), err
+}
+
+// syncModes gives or takes OP for the given nicks, if present, based on the current OPs list.
+// The channel is given by its OPs file key, and modes are synced on all networks using it.
+func syncModes(channel string, nicks []string) {
+	c := ops().Get(channel)
+	now := time.Now()
+	nets, name := networksFor(channel)
+	for _, n := range nets {
+		for _, nick := range nicks {
+			m := n.roster.Get(name, nick)
+			if m == nil {
+				continue
+			}
+			should := c.MatchHostMask(nick, m.Mask) && c.OnShift(nick, now)
+			if should && !m.OP {
+				n.mode(name, "+o", nick)
+			} else if !should && m.OP && !c.Has(nick) {
+				n.mode(name, "-o", nick)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package opbot
+
+/*
+Prometheus metrics. They're kept in a registry of our own, so we don't mess with
+the default registry of whatever program is using the plugin, and are only
+exposed if the program serves MetricsHandler() somewhere.
+*/
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NS string = "opbot"
+)
+
+var (
+	_registry = prometheus.NewRegistry()
+
+	_mJoins = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "joins_total",
+		Help:      "Channel joins seen, not counting the bot itself.",
+	})
+	_mOPGranted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "ops_granted_total",
+		Help:      "Times the bot has given OP to a nick in the OPs list, by what triggered it.",
+	}, []string{"trigger"})
+	_mOPDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "ops_denied_total",
+		Help:      "Times a nick in the OPs list did not get OP, by what triggered it and why.",
+	}, []string{"trigger", "reason"})
+	_mCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "commands_total",
+		Help:      "!op commands run, by subcommand and result (ok, error, denied or limited).",
+	}, []string{"command", "result"})
+	_mVisitorWelcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "visitor_welcomes_total",
+		Help:      "Welcome messages for visitors, by result (sent, or limited during join floods).",
+	}, []string{"result"})
+	_mFloods = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "floods_total",
+		Help:      "Join floods and clones detected, by kind (joins or clones).",
+	}, []string{"kind"})
+	_mSpam = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "spam_total",
+		Help:      "Spam offences, by the limit passed and the action taken.",
+	}, []string{"reason", "action"})
+	_mSendQueue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: METRICS_NS,
+		Name:      "send_queue_length",
+		Help:      "Lines waiting in the send queue, by network.",
+	}, []string{"network"})
+	_mSendDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "send_dropped_total",
+		Help:      "Lines dropped because the send queue was full, by network.",
+	}, []string{"network"})
+	_mWhoisTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "whois_timeouts_total",
+		Help:      "WHOIS lookups that got no reply in time.",
+	})
+	_mSaveErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NS,
+		Name:      "save_errors_total",
+		Help:      "Failed saves of the OPs file.",
+	})
+	_mSaveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NS,
+		Name:      "save_duration_seconds",
+		Help:      "Time taken to save the OPs file.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	})
+
+	_dChannels = prometheus.NewDesc(METRICS_NS+"_channels", "Channels in the OPs list.", nil, nil)
+	_dUsers    = prometheus.NewDesc(METRICS_NS+"_users", "Nicks in the OPs list.", []string{"channel"}, nil)
+	_dMasks    = prometheus.NewDesc(METRICS_NS+"_masks", "Hostmasks in the OPs list.", []string{"channel"}, nil)
+)
+
+// opsCollector gives gauges for the OPs list as it is when scraped
+type opsCollector struct{}
+
+func init() {
+	_registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		_mJoins,
+		_mOPGranted,
+		_mOPDenied,
+		_mCommands,
+		_mVisitorWelcomes,
+		_mFloods,
+		_mSpam,
+		_mSendQueue,
+		_mSendDropped,
+		_mWhoisTimeouts,
+		_mSaveErrors,
+		_mSaveDuration,
+		opsCollector{},
+	)
+}
+
+// MetricsHandler returns a handler for serving the metrics to Prometheus, usually at /metrics
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(_registry, promhttp.HandlerOpts{})
+}
+
+func (opsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- _dChannels
+	ch <- _dUsers
+	ch <- _dMasks
+}
+
+func (opsCollector) Collect(ch chan<- prometheus.Metric) {
+	ops := ops()
+	if ops == nil {
+		return
+	}
+	names := ops.ChannelNames()
+	ch <- prometheus.MustNewConstMetric(_dChannels, prometheus.GaugeValue, float64(len(names)))
+	for _, name := range names {
+		c := ops.Get(name)
+		c.RLock()
+		masks := 0
+		for _, m := range c.OPs {
+			masks += len(m)
+		}
+		ch <- prometheus.MustNewConstMetric(_dUsers, prometheus.GaugeValue, float64(len(c.OPs)), name)
+		ch <- prometheus.MustNewConstMetric(_dMasks, prometheus.GaugeValue, float64(masks), name)
+		c.RUnlock()
+	}
+}
+
+// cmdLabel gives the subcommand as a label value, without letting junk arguments
+// blow up the number of label values
+func cmdLabel(subcmd string) string {
+	for _, c := range []string{ADD, BANMASK, CLEAR, DEL, FLOOD, GET, GREET, IDLE, KB, LOG, LS, MASK, MODELOCK, QUIET, RELOAD, SCHED, SPAM, TEMPOP, UNDO, UNQUIET, VMSG, WMSG} {
+		if match(subcmd, c) {
+			return strings.ToLower(c)
+		}
+	}
+	return "unknown"
+}
+
+func observeSave(start time.Time, err error) {
+	_mSaveDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		_mSaveErrors.Inc()
+	}
+}
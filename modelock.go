@@ -0,0 +1,284 @@
+package opbot
+
+/*
+Mode locks. A channel may have a mode lock, like "+ntk-is key", with modes that
+should always be set, and modes that should never be. The bot checks the
+channel's modes against the lock when it joins or gets OP, and puts back any
+change that goes against it, from anyone but itself. It can only do so while it
+has OP.
+
+Only simple modes, and k and l, can be locked. List modes like bans, and modes
+giving nicks a status like OP, can't.
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+// ModeLock is a parsed mode lock
+type ModeLock struct {
+	set   map[rune]string // modes that should be set, with parameters for k and l
+	unset map[rune]bool   // modes that should not be set
+}
+
+// ParseModeLock parses a mode lock, like "+ntk-is key"
+func ParseModeLock(s string) (*ModeLock, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || (fields[0][0] != '+' && fields[0][0] != '-') {
+		return nil, fmt.Errorf("expected modes like +nt-i, with parameters for k and l")
+	}
+	ml := &ModeLock{set: make(map[rune]string), unset: make(map[rune]bool)}
+	params := fields[1:]
+	set := true
+	for _, m := range fields[0] {
+		switch {
+		case m == '+' || m == '-':
+			set = m == '+'
+			continue
+		case m > 127 || !isLetter(byte(m)) || (m != 'k' && strings.ContainsRune(paramModes, m)):
+			return nil, fmt.Errorf("mode %c can't be locked", m)
+		}
+		if _, found := ml.set[m]; found || ml.unset[m] {
+			return nil, fmt.Errorf("mode %c is given more than once", m)
+		}
+		if !set {
+			ml.unset[m] = true
+			continue
+		}
+		var p string
+		if m == 'k' || m == 'l' {
+			if len(params) == 0 {
+				return nil, fmt.Errorf("+%c needs a parameter", m)
+			}
+			p, params = params[0], params[1:]
+		}
+		if m == 'k' && strings.Contains(p, ",") {
+			return nil, fmt.Errorf("invalid key %q", p)
+		}
+		if l, err := strconv.Atoi(p); m == 'l' && (err != nil || l <= 0) {
+			return nil, fmt.Errorf("+l needs a limit above 0")
+		}
+		ml.set[m] = p
+	}
+	if len(params) > 0 {
+		return nil, fmt.Errorf("too many parameters")
+	}
+	if len(ml.set) == 0 && len(ml.unset) == 0 {
+		return nil, fmt.Errorf("no modes given")
+	}
+	return ml, nil
+}
+
+// ValidModeLock tells if s can be used as a mode lock
+func ValidModeLock(s string) bool {
+	_, err := ParseModeLock(s)
+	return err == nil
+}
+
+// String gives the lock as it's parsed, like "+knt-is key", with modes in order
+func (ml *ModeLock) String() string {
+	changes := make([]modeChange, 0, len(ml.set)+len(ml.unset))
+	for _, m := range ml.setModes() {
+		changes = append(changes, modeChange{Set: true, Mode: m, Param: ml.set[m]})
+	}
+	for _, m := range sortedModes(ml.unset) {
+		changes = append(changes, modeChange{Mode: m})
+	}
+	return strings.Join(formatModes(changes), " ")
+}
+
+// fix gives the changes needed for a channel with the current modes, from a 324 reply, to match the lock
+func (ml *ModeLock) fix(current []modeChange) []modeChange {
+	cur := make(map[rune]string, len(current))
+	for _, mc := range current {
+		cur[mc.Mode] = mc.Param
+	}
+	changes := make([]modeChange, 0)
+	for _, m := range sortedModes(ml.unset) {
+		if p, found := cur[m]; found {
+			if m != 'k' {
+				p = ""
+			}
+			changes = append(changes, modeChange{Mode: m, Param: p})
+		}
+	}
+	for _, m := range ml.setModes() {
+		p := ml.set[m]
+		have, found := cur[m]
+		switch {
+		case !found:
+			changes = append(changes, modeChange{Set: true, Mode: m, Param: p})
+		case m == 'k' && have != p && have != "" && have != "*": // "*" when the server hides the key
+			changes = append(changes, modeChange{Mode: 'k', Param: have}, modeChange{Set: true, Mode: 'k', Param: p})
+		case m == 'l' && have != p:
+			changes = append(changes, modeChange{Set: true, Mode: m, Param: p})
+		}
+	}
+	return changes
+}
+
+// reverts gives the changes that undo those in changes going against the lock
+func (ml *ModeLock) reverts(changes []modeChange) []modeChange {
+	reverts := make([]modeChange, 0)
+	for _, mc := range changes {
+		p, locked := ml.set[mc.Mode]
+		switch {
+		case mc.Set && ml.unset[mc.Mode]:
+			if mc.Mode != 'k' {
+				mc.Param = ""
+			}
+			reverts = append(reverts, modeChange{Mode: mc.Mode, Param: mc.Param})
+		case mc.Set && locked && mc.Mode == 'k' && mc.Param != p:
+			reverts = append(reverts, modeChange{Mode: 'k', Param: mc.Param}, modeChange{Set: true, Mode: 'k', Param: p})
+		case mc.Set && locked && mc.Mode == 'l' && mc.Param != p:
+			reverts = append(reverts, modeChange{Set: true, Mode: 'l', Param: p})
+		case !mc.Set && locked:
+			reverts = append(reverts, modeChange{Set: true, Mode: mc.Mode, Param: p})
+		}
+	}
+	return reverts
+}
+
+// setModes gives the modes that should be set, in order
+func (ml *ModeLock) setModes() []rune {
+	modes := make(map[rune]bool, len(ml.set))
+	for m := range ml.set {
+		modes[m] = true
+	}
+	return sortedModes(modes)
+}
+
+func sortedModes(modes map[rune]bool) []rune {
+	sorted := make([]rune, 0, len(modes))
+	for m := range modes {
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// formatModes gives changes as MODE arguments, like ["+nt-k", "key"]
+func formatModes(changes []modeChange) []string {
+	var modes strings.Builder
+	params := make([]string, 0)
+	sign := ' '
+	for _, mc := range changes {
+		s := '-'
+		if mc.Set {
+			s = '+'
+		}
+		if s != sign {
+			modes.WriteRune(s)
+			sign = s
+		}
+		modes.WriteRune(mc.Mode)
+		if mc.Param != "" {
+			params = append(params, mc.Param)
+		}
+	}
+	return append([]string{modes.String()}, params...)
+}
+
+// modeLock gives the mode lock for channel, or nil if there is none
+func modeLock(c *Channel) *ModeLock {
+	c.RLock()
+	s := c.ModeLock
+	c.RUnlock()
+	if s == "" {
+		return nil
+	}
+	ml, err := ParseModeLock(s)
+	if err != nil {
+		return nil // checked when loaded, so should not happen
+	}
+	return ml
+}
+
+func addModeLockCallbacks(n *Network) {
+	n.Conn.AddCallback("MODE", n.onModeLockMODE)
+	// 324 is the reply to a MODE query: <me> <channel> <modes> [params...]
+	n.Conn.AddCallback("324", func(e *ircevent.Event) {
+		if len(e.Arguments) < 3 {
+			return
+		}
+		channel := e.Arguments[1]
+		if ml := modeLock(n.channel(channel)); ml != nil {
+			n.enforceModeLock(channel, ml.fix(parseModes(e.Arguments[2], e.Arguments[3:], n.server.modeParams())))
+		}
+	})
+}
+
+// onModeLockMODE checks the channel's modes when the bot gets OP, and puts back changes going against the lock
+func (n *Network) onModeLockMODE(e *ircevent.Event) {
+	if len(e.Arguments) < 2 || !isChannel(e.Arguments[0]) {
+		return
+	}
+	channel := e.Arguments[0]
+	ml := modeLock(n.channel(channel))
+	if ml == nil {
+		return
+	}
+	changes := parseModes(e.Arguments[1], e.Arguments[2:], n.server.modeParams())
+	for _, mc := range changes {
+		if mc.Mode == 'o' && mc.Set && mc.Param == n.Conn.GetNick() {
+			n.mode(channel) // the 324 reply tells what to fix
+			return
+		}
+	}
+	if e.Nick == n.Conn.GetNick() {
+		return
+	}
+	n.enforceModeLock(channel, ml.reverts(changes))
+}
+
+// enforceModeLock makes the given changes in channel, if there are any, and the bot has OP
+func (n *Network) enforceModeLock(channel string, changes []modeChange) {
+	if len(changes) == 0 {
+		return
+	}
+	if m := n.roster.Get(channel, n.Conn.GetNick()); m == nil || !m.OP {
+		devdbg("%s: %s: Not OP in %s, unable to enforce mode lock", PLUGIN, n.Name, channel)
+		return
+	}
+	args := formatModes(changes)
+	log.Infof("%s: %s: Enforcing mode lock in %s: %s", PLUGIN, n.Name, channel, strings.Join(args, " "))
+	n.mode(channel, args...)
+}
+
+// modeLockCmd shows, sets or clears the mode lock for channel
+func (n *Network) modeLockCmd(channel string, by origin, action, lock string) (string, error) {
+	var err error
+	c := n.channel(channel)
+
+	if match(action, SET) {
+		ml, perr := ParseModeLock(lock)
+		if perr != nil {
+			return fmt.Sprintf("%s: Invalid mode lock %q: %s", PLUGIN, lock, perr.Error()), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.ModeLock = ml.String()
+			c.Unlock()
+		})
+		n.mode(channel) // the 324 reply tells what to fix
+	} else if match(action, CLEAR) {
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.ModeLock = ""
+			c.Unlock()
+		})
+	} else if action != "" && !match(action, GET) {
+		return fmt.Sprintf("%s: Usage: !op %s <get|set|clear> [modes [key] [limit]]", PLUGIN, strings.ToLower(MODELOCK)), nil
+	}
+
+	if ml := modeLock(c); ml != nil {
+		return fmt.Sprintf("%s: Mode lock for %s: %s", PLUGIN, channel, ml.String()), err
+	}
+	return fmt.Sprintf("%s: No mode lock for %s", PLUGIN, channel), err
+}
@@ -0,0 +1,158 @@
+package opbot
+
+/*
+A Network is one IRC connection the plugin works on. A program may connect to
+several networks at once, all sharing the same OPs file. Each network keeps its
+channels in a namespace in the OPs file: networks in the same namespace share
+OPs lists, so that e.g. #chan on both OFTC and Libera have the same OPs, while
+networks in different namespaces have their own.
+
+The default namespace is "", where channels are keyed by their name only, as
+before there were networks. In other namespaces, channels are keyed as
+"namespace/#channel". The journal, the audit log and the admin API all use
+these keys for channels.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-chat-bot/bot"
+	"github.com/go-chat-bot/bot/irc"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+// A Network is one IRC connection. Its Name is also what bans and modes to lift later are
+// kept under in the OPs file, so it should stay the same across restarts, even if another
+// server is connected to.
+type Network struct {
+	Name      string // shown in logs, health status and the audit log. Defaults to the server address.
+	Namespace string // namespace for the network's channels in the OPs file, "" for the default
+	Bot       *bot.Bot
+	Config    *irc.Config
+	Conn      *ircevent.Connection
+	SendRate  SendRate // how fast to send to the server, zero for the defaults
+
+	caller Caller
+	wchan  chan *HostMask // WHOIS replies
+	roster *Roster
+	vlimit *Limiters // visitor welcome messages, by channel
+	climit *Limiters // commands, by caller
+	wlimit *Limiters // commands that send a WHOIS, by caller
+	floods *floodState
+	msgs   *spamState // recent messages and spam offences
+	sendq  *sendQueue
+	server *isupport    // what the server supports, from 005 replies
+	chMu   sync.RWMutex // guards Config.Channels, which may change on SIGHUP
+}
+
+// Channels gives a copy of the channels to be in, as "#chan" or "#chan key"
+func (n *Network) Channels() []string {
+	n.chMu.RLock()
+	defer n.chMu.RUnlock()
+	return append([]string(nil), n.Config.Channels...)
+}
+
+// SetChannels changes the channels to be in, without joining or parting any
+func (n *Network) SetChannels(channels []string) {
+	n.chMu.Lock()
+	defer n.chMu.Unlock()
+	n.Config.Channels = channels
+}
+
+// _networks is set once by InitNetworks, and never changed after that
+var _networks []*Network
+
+// Key gives the OPs file key for channel in namespace
+func Key(namespace, channel string) string {
+	if namespace == "" {
+		return channel
+	}
+	return namespace + "/" + channel
+}
+
+// SplitKey splits an OPs file key into namespace and channel name
+func SplitKey(key string) (namespace, channel string) {
+	if isChannel(key) {
+		return "", key
+	}
+	if i := strings.Index(key, "/"); i > -1 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// ValidNamespace tells if ns can be used as a namespace
+func ValidNamespace(ns string) bool {
+	return ns == "" || !(isChannel(ns) || strings.ContainsAny(ns, "/ ,"))
+}
+
+func (n *Network) init() error {
+	if n.Bot == nil || n.Config == nil || n.Conn == nil {
+		return fmt.Errorf("network %q: bot, config and connection are all needed", n.Name)
+	}
+	if n.Name == "" {
+		n.Name = n.Config.Server
+	}
+	if !ValidNamespace(n.Namespace) {
+		return fmt.Errorf("network %q: invalid namespace %q", n.Name, n.Namespace)
+	}
+	n.caller = Caller{}
+	n.wchan = make(chan *HostMask, 8) // 8 is just a guess, that it should be (more than) enough
+	n.roster = NewRoster()
+	n.vlimit = NewLimiters(VMSG_RATE, VMSG_BURST)
+	n.climit = NewLimiters(CMD_RATE, CMD_BURST)
+	n.wlimit = NewLimiters(WHOIS_RATE, WHOIS_BURST)
+	n.floods = newFloodState()
+	n.msgs = newSpamState()
+	n.server = newISupport()
+	n.sendq = newSendQueue(n.Name, n.SendRate, n.sendLine)
+	go n.sendq.run()
+	return nil
+}
+
+// key gives the OPs file key for channel on this network
+func (n *Network) key(channel string) string {
+	return Key(n.Namespace, channel)
+}
+
+// channel gives the OPs list for channel on this network
+func (n *Network) channel(channel string) *Channel {
+	return ops().Get(n.key(channel))
+}
+
+// opIn tells if the bot is connected, and has OP in channel
+func (n *Network) opIn(channel string) bool {
+	if !n.Conn.Connected() {
+		return false
+	}
+	m := n.roster.Get(channel, n.Conn.GetNick())
+	return m != nil && m.OP
+}
+
+// networkFor finds the network a command came from, by the server it came through,
+// or nil if it's none of ours. Servers are unique, as checked by InitNetworks.
+func networkFor(cmd *bot.Cmd) *Network {
+	if cmd.ChannelData != nil {
+		for _, n := range _networks {
+			if n.Config.Server == cmd.ChannelData.Server {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// networksFor gives the networks that use the channel with the given OPs file key,
+// and the name of the channel on them
+func networksFor(key string) ([]*Network, string) {
+	ns, channel := SplitKey(key)
+	nets := make([]*Network, 0, 1)
+	for _, n := range _networks {
+		if n.Namespace == ns {
+			nets = append(nets, n)
+		}
+	}
+	return nets, channel
+}
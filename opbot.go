@@ -22,14 +22,28 @@ TODO:
 - [*] Make it possible to customize welcome message
 - [-] give feedback on wrong arguments?
 - [ ] Check hostmask, not just if nick is in list, when calling modifying commands
+- [*] Temporary OPs that expire by themselves
+- [*] Schedules for when a nick should hold OP
+- [*] DEOP idle OPs, and give OP back when they're active again
+- [*] Undo changes to the OPs list
+- [*] Join-flood and clone protection
+- [*] Message flood and spam protection
+- [*] Throttle outgoing lines, to not get disconnected for flooding
+- [*] Kick-bans, lifted after a given time
+- [*] Quiets, the way each server supports them
+- [*] Mode lock
 */
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
 	"github.com/go-chat-bot/bot"
 	"github.com/go-chat-bot/bot/irc"
 	ircevent "github.com/thoj/go-ircevent"
@@ -37,14 +51,34 @@ import (
 
 const (
 	ADD        string = "ADD"
+	BANMASK    string = "BANMASK"
 	CLEAR      string = "CLEAR"
+	COOLDOWN   string = "COOLDOWN"
 	DEL        string = "DEL"
+	EXCLUDE    string = "EXCLUDE"
+	FLOOD      string = "FLOOD"
+	FOR        string = "--FOR"
 	GET        string = "GET"
+	GREET      string = "GREET"
+	IDLE       string = "IDLE"
 	JOIN       string = "JOIN"
+	KB         string = "KB"
+	LIFT       string = "LIFT"
+	LOG        string = "LOG"
 	LS         string = "LS"
 	MASK       string = "MASK"
+	MODE       string = "MODE"
+	MODELOCK   string = "MODELOCK"
+	OFF        string = "OFF"
+	QUIET      string = "QUIET"
 	RELOAD     string = "RELOAD"
+	SCHED      string = "SCHED"
 	SET        string = "SET"
+	SPAM       string = "SPAM"
+	TEMPOP     string = "TEMPOP"
+	UNDO       string = "UNDO"
+	UNQUIET    string = "UNQUIET"
+	VMSG       string = "VMSG"
 	WMSG       string = "WMSG"
 	PLUGIN     string = "OPBot"
 	DEF_OPFILE string = "/tmp/opbot.json"
@@ -52,36 +86,100 @@ const (
 )
 
 var (
-	_bot       *bot.Bot
-	_cfg       *irc.Config
-	_conn      *ircevent.Connection
-	_ops       *OPData
-	_opfile    string
-	_caller    Caller
-	_wcTimeout time.Duration             // how long to wait reading _wchan
-	_wchan     = make(chan *HostMask, 8) // 8 is just a guess, that it should be (more than) enough
+	_ops        *OPData // swapped on reload, see ops()
+	_opsMu      sync.RWMutex
+	_opfile     string
+	_wcTimeout  time.Duration // how long to wait for WHOIS replies
+	_schedTick  time.Duration // how often the scheduler checks for things to do
+	_errDenied  = errors.New("caller not in OPs list")
+	_errPending = errors.New("waiting for WHOIS") // the outcome is audited when the reply comes
 )
 
+// InitBot sets up the plugin on a single network, using the default namespace in the OPs file
 func InitBot(b *bot.Bot, cfg *irc.Config, conn *ircevent.Connection, opfile string) error {
-	_bot = b
-	_cfg = cfg
-	_conn = conn
+	return InitNetworks(opfile, &Network{Bot: b, Config: cfg, Conn: conn})
+}
+
+// InitNetworks sets up the plugin on one or more networks, sharing the OPs file.
+// Call it once, before connecting.
+func InitNetworks(opfile string, networks ...*Network) error {
+	if len(networks) == 0 {
+		return fmt.Errorf("%s: No networks to work on", PLUGIN)
+	}
+	seen := make(map[string]bool)
+	servers := make(map[string]bool)
+	for _, n := range networks {
+		if err := n.init(); err != nil {
+			return err
+		}
+		if seen[n.Name] {
+			return fmt.Errorf("%s: Network %q given more than once", PLUGIN, n.Name)
+		}
+		if servers[n.Config.Server] { // commands are routed by server, see networkFor
+			return fmt.Errorf("%s: Network %q: server %q is used by another network", PLUGIN, n.Name, n.Config.Server)
+		}
+		seen[n.Name] = true
+		servers[n.Config.Server] = true
+	}
+
+	_networks = networks
 	_opfile = opfile
-	_caller = Caller{}
 	_wcTimeout = 2 * time.Second // adjust as needed
-	reload()                     // initializes _ops
+	_schedTick = 30 * time.Second
+	reload() // initializes _ops
 
-	_conn.AddCallback(JOIN, onJOIN)         // Triggers giving OP if nick is in list
-	_conn.AddCallback("PRIVMSG", onPRIVMSG) // for keeping track of calling user
-	_conn.AddCallback("311", on311)         // reply from whois when nick found
-	_conn.AddCallback("401", on401)         // reply from whois when nick not found
+	for _, n := range _networks {
+		n.Conn.AddCallback(JOIN, n.onJOIN)         // Triggers giving OP if nick is in list
+		n.Conn.AddCallback("PRIVMSG", n.onPRIVMSG) // for keeping track of calling user
+		n.Conn.AddCallback("311", n.on311)         // reply from whois when nick found
+		n.Conn.AddCallback("401", n.on401)         // reply from whois when nick not found
+		n.Conn.AddCallback("001", func(e *ircevent.Event) {
+			n.server.reset() // we may have reconnected to another server
+		})
+		n.Conn.AddCallback("005", n.on005) // what the server supports, e.g. for quiets
+		addRosterCallbacks(n)              // keeps track of who is present in our channels
+		addSpamCallbacks(n)                // message flood and spam protection
+		addModeLockCallbacks(n)            // keeps locked modes set and unset
+	}
 
 	register()
+	startScheduler(_schedTick)
 
-	// Maybe I'll change signature to not return anything, as there will never be an error to return...
 	return nil
 }
 
+// Reload reloads the OPs file, e.g. on SIGHUP
+func Reload() error {
+	_changeMu.Lock()
+	defer _changeMu.Unlock()
+	reload()
+	return _ops.LoadError()
+}
+
+// Shutdown waits for any change in progress to be saved, and stops further changes.
+// If the last save failed, it tries again. Then it QUITs from all networks with msg.
+// Returns an error if there are changes that could not be saved.
+func Shutdown(msg string) error {
+	_changeMu.Lock() // never unlocked, as we're going away
+	return shutdown(msg)
+}
+
+// shutdown does the work for Shutdown. Caller must hold _changeMu.
+func shutdown(msg string) error {
+	var err error
+	if _ops != nil && _ops.Unsaved() {
+		log.Warnf("%s: Retrying failed save of %q before shutting down", PLUGIN, _opfile)
+		err = _ops.SaveFile(_opfile)
+	}
+	for _, n := range _networks {
+		if n.Conn.Connected() {
+			n.Conn.QuitMessage = msg
+			n.Conn.Quit()
+		}
+	}
+	return err
+}
+
 func register() {
 	bot.RegisterCommand(
 		"op",
@@ -93,102 +191,202 @@ func register() {
 
 // onPRIVMSG just keeps track of the last nick/mask to say something/give a command.
 // It's a bit buggy, as if someone gives a command to the bot first thing after it
-// has joined, this func will run afterwards, and so _caller is not updated at first command.
-func onPRIVMSG(e *ircevent.Event) {
+// has joined, this func will run afterwards, and so n.caller is not updated at first command.
+func (n *Network) onPRIVMSG(e *ircevent.Event) {
 	const fn string = "onPRIVMSG()"
-	_caller.Nick = e.Nick
-	_caller.Hostmask = e.Source
-	devdbg("%s: %s: Caller: %#v", PLUGIN, fn, _caller)
+	n.caller.Nick = e.Nick
+	n.caller.Hostmask = e.Source
+	devdbg("%s: %s: %s: Caller: %#v", PLUGIN, fn, n.Name, n.caller)
+	n.onActivity(e)
 }
 
 // 311 is the reply to WHOIS when nick found
-func on311(e *ircevent.Event) {
+func (n *Network) on311(e *ircevent.Event) {
 	//devdbg("%+v", e)
 	const fn string = "on311()"
 
 	hm := &HostMask{
-		Nick:     e.Arguments[1],
-		UserID:   e.Arguments[2],
-		Host:     e.Arguments[3],
+		Nick:   e.Arguments[1],
+		UserID: e.Arguments[2],
+		Host:   e.Arguments[3],
 		//RealName: e.Arguments[5], // never used
 	}
 	select {
-	case _wchan <- hm:
-		devdbg("%s: %s: Sent hostmask object on _wchan", PLUGIN, fn)
+	case n.wchan <- hm:
+		devdbg("%s: %s: Sent hostmask object on n.wchan", PLUGIN, fn)
 	default:
-		devdbg("%s: %s: Unable to send on _wchan", PLUGIN, fn)
+		devdbg("%s: %s: Unable to send on n.wchan", PLUGIN, fn)
 	}
 }
 
 // 401 is the reply from WHOIS when nick NOT found
-func on401(e *ircevent.Event) {
+func (n *Network) on401(e *ircevent.Event) {
 	const fn string = "on401()"
 
 	select {
-	case _wchan <- nil:
-		devdbg("%s: %s: Sent NIL hostmask object on _wchan", PLUGIN, fn)
+	case n.wchan <- nil:
+		devdbg("%s: %s: Sent NIL hostmask object on n.wchan", PLUGIN, fn)
 	default:
-		devdbg("%s: %s: Unable to send on _wchan", PLUGIN, fn)
+		devdbg("%s: %s: Unable to send on n.wchan", PLUGIN, fn)
 	}
 }
 
-func onJOIN(e *ircevent.Event) {
+func (n *Network) onJOIN(e *ircevent.Event) {
 	const fn string = "onJOIN()"
 
-	if e.Nick == _conn.GetNick() {
+	if e.Nick == n.Conn.GetNick() {
 		devdbg("%s: %s: Seems it's myself joining. e.Nick: %s", PLUGIN, fn, e.Nick)
+		n.roster.Drop(e.Arguments[0])
+		n.who(e.Arguments[0]) // get hostmasks for everyone already present
+		if modeLock(n.channel(e.Arguments[0])) != nil {
+			n.mode(e.Arguments[0]) // the 324 reply tells what to fix, once we have OP
+		}
 		return
 	}
+	lastSeen := n.roster.LastSeen(e.Arguments[0], e.Nick)
+	n.roster.Join(e.Arguments[0], e.Nick, e.Source)
+	_mJoins.Inc()
+
+	wd := &WelcomeData{
+		Nick:     e.Nick,
+		User:     e.User,
+		Host:     e.Host,
+		Channel:  e.Arguments[0],
+		Users:    len(n.roster.Members(e.Arguments[0])),
+		LastSeen: lastSeen,
+	}
+	if len(e.Arguments) > 2 && e.Arguments[1] != "*" {
+		wd.Account = e.Arguments[1] // extended-join: <channel> <account> :<realname>
+	}
+
+	c := n.channel(e.Arguments[0])
+	if c.MatchVoice(e.Nick, e.Source) {
+		devdbg("%s: %s: Setting mode %q for %q in %q", PLUGIN, fn, "+v", e.Nick, e.Arguments[0])
+		n.mode(e.Arguments[0], "+v", e.Nick)
+		wd.Level = "voice"
+	}
 
-	c := _ops.Get(e.Arguments[0])
 	if c.Empty() {
-		devdbg("%s: %s: OPs list is empty, nothing to do", PLUGIN, fn)
+		devdbg("%s: %s: OPs list is empty, nothing more to do than welcome visitors", PLUGIN, fn)
+		n.visitor(e, c, wd)
 		return
 	}
 
 	if !c.Has(e.Nick) {
-		devdbg("%s: %s: %s not in OPs list, ignoring", PLUGIN, fn, e.Nick)
+		devdbg("%s: %s: %s not in OPs list, welcoming as visitor", PLUGIN, fn, e.Nick)
+		n.visitor(e, c, wd)
 		return
 	}
 
 	if !c.MatchHostMask(e.Nick, e.Source) {
 		devdbg("%s: %s: No match on hostmask %q for nick %q", PLUGIN, fn, e.Source, e.Nick)
+		_mOPDenied.WithLabelValues("join", "hostmask").Inc()
+		n.visitor(e, c, wd)
+		return
+	}
+
+	if !c.OnShift(e.Nick, time.Now()) {
+		devdbg("%s: %s: %q is off shift, no OP for now", PLUGIN, fn, e.Nick)
+		_mOPDenied.WithLabelValues("join", "off_shift").Inc()
 		return
 	}
 
 	// Set OP for nick
 	devdbg("%s: %s: Setting mode %q for %q in %q", PLUGIN, fn, "+o", e.Nick, e.Arguments[0])
-	_conn.Mode(e.Arguments[0], "+o", e.Nick)
+	n.mode(e.Arguments[0], "+o", e.Nick)
+	_mOPGranted.WithLabelValues("join").Inc()
 
 	// Welcome the OP user, if welcome message is configured
-	if c.WelcomeMsg != "" {
-		_bot.SendMessage(
-			e.Arguments[0], // will be the channel name
-			c.GetWMsg(e.Nick),
-			&bot.User{
-				ID:       e.Host,
-				Nick:     e.Nick,
-				RealName: e.User,
-			},
-		)
+	wd.Level = "op"
+	if _, found := c.Expiry(e.Nick); found {
+		wd.Level = "tempop"
+	}
+	msg := welcomeMsg(n.key(e.Arguments[0]), c, wd)
+	if msg == "" {
+		return
+	}
+	if !n.roster.Greet(e.Arguments[0], e.Nick, welcomeCooldown(n.key(e.Arguments[0]), c)) {
+		devdbg("%s: %s: %q was welcomed recently, not again", PLUGIN, fn, e.Nick)
+		return
+	}
+	switch welcomeMode(n.key(e.Arguments[0]), c) {
+	case WMODE_NOTICE:
+		n.Notice(e.Nick, msg)
+	case WMODE_PRIVATE:
+		n.Privmsg(e.Nick, msg)
+	default:
+		n.Privmsg(e.Arguments[0], msg) // will be the channel name
+	}
+}
+
+// visitor takes care of a nick joining that doesn't get OP
+func (n *Network) visitor(e *ircevent.Event, c *Channel, wd *WelcomeData) {
+	if n.checkJoinFlood(e, c) {
+		return // no welcome messages for flooders
+	}
+	n.welcomeVisitor(e, c, wd)
+}
+
+// welcomeVisitor sends the visitor welcome message, if any, to a nick joining that doesn't get OP
+func (n *Network) welcomeVisitor(e *ircevent.Event, c *Channel, wd *WelcomeData) {
+	const fn string = "welcomeVisitor()"
+
+	msg := visitorMsg(n.key(e.Arguments[0]), c, wd)
+	if msg == "" {
+		return
+	}
+	if c.VisitorExcluded(e.Source) {
+		devdbg("%s: %s: %q is excluded from visitor welcome messages", PLUGIN, fn, e.Source)
+		return
+	}
+	if !n.roster.Greet(e.Arguments[0], e.Nick, welcomeCooldown(n.key(e.Arguments[0]), c)) {
+		devdbg("%s: %s: %q was welcomed recently, not again", PLUGIN, fn, e.Nick)
+		return
+	}
+	if !n.vlimit.Allow(e.Arguments[0]) {
+		devdbg("%s: %s: Too many visitors in %q, not welcoming %q", PLUGIN, fn, e.Arguments[0], e.Nick)
+		_mVisitorWelcomes.WithLabelValues("limited").Inc()
+		return
 	}
+	n.Notice(e.Nick, msg)
+	_mVisitorWelcomes.WithLabelValues("sent").Inc()
 }
 
-func ls(channel, nick string) string {
-	c := _ops.Get(channel)
+func (n *Network) ls(channel, nick string) string {
+	c := n.channel(channel)
 	if c.Empty() {
 		return fmt.Sprintf("%s: No configured OPs for channel %q", PLUGIN, channel)
 	}
+	// Expired entries are left out, as they're about to be removed by the scheduler
+	expired := func(nick string) bool {
+		t, found := c.Expiry(nick)
+		return found && !time.Now().Before(t)
+	}
 	if nick == "" {
-		return fmt.Sprintf("%s: OPs for %s: %s", PLUGIN, channel, strings.Join(c.Nicks(), ", "))
+		nicks := make([]string, 0)
+		for _, nick := range c.Nicks() {
+			if expired(nick) {
+				continue
+			}
+			if t, found := c.Expiry(nick); found {
+				nick = fmt.Sprintf("%s (%s left)", nick, fmtDuration(time.Until(t)))
+			}
+			nicks = append(nicks, nick)
+		}
+		return fmt.Sprintf("%s: OPs for %s: %s", PLUGIN, channel, strings.Join(nicks, ", "))
 	}
-	if c.Has(nick) {
+	if c.Has(nick) && !expired(nick) {
+		if t, found := c.Expiry(nick); found {
+			return fmt.Sprintf("%s: %s is registered as OP for %s more", PLUGIN, nick, fmtDuration(time.Until(t)))
+		}
 		return fmt.Sprintf("%s: %s is registered as OP", PLUGIN, nick)
 	}
 	return fmt.Sprintf("%s: %s is NOT registered as OP", PLUGIN, nick)
 }
 
-func add(channel, nick string) (string, error) {
+// add looks up the hostmask for nick and adds it to the OPs list.
+// If ttl is > 0, the entry is temporary and will be removed by the scheduler when it expires.
+func (n *Network) add(channel string, by origin, nick string, ttl time.Duration) (string, error) {
 	const fn string = "add()"
 
 	if nick == "" {
@@ -196,65 +394,96 @@ func add(channel, nick string) (string, error) {
 		return emsg, fmt.Errorf(emsg)
 	}
 
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
 	go func() {
-		devdbg("%s: %s: Goroutine waiting to read from _wchan...", PLUGIN, fn)
-		hm := readWhois(_wcTimeout)
+		devdbg("%s: %s: Goroutine waiting to read from n.wchan...", PLUGIN, fn)
+		hm := n.readWhois(_wcTimeout)
 
 		if hm == nil {
-			devdbg("%s: %s: Got NIL hostmask back on _wchan. %q does not exist on server", PLUGIN, fn, nick)
-			_bot.SendMessage(
-				channel,
-				fmt.Sprintf("%s: Error adding %q - no such nick", PLUGIN, nick),
-				nil,
-			)
+			devdbg("%s: %s: Got NIL hostmask back on n.wchan. %q does not exist on server", PLUGIN, fn, nick)
+			msg := fmt.Sprintf("%s: Error adding %q - no such nick", PLUGIN, nick)
+			n.Privmsg(channel, msg)
+			n.auditLater(channel, by, msg, nil)
 			return
 		}
 
 		devdbg("%s: %s: Got back info about nick %q: %#v", PLUGIN, fn, nick, hm)
 
-		added := _ops.Get(channel).Add(nick, hm.String())
-		devdbg("%s: %s: Nick %q with mask %q added: %t", PLUGIN, fn, nick, hm.String(), added)
+		_, err := change(n.key(channel), by, func(c *Channel) {
+			added := c.Add(nick, hm.String())
+			c.SetExpiry(nick, expires) // zero value makes an existing temporary entry permanent
+			devdbg("%s: %s: Nick %q with mask %q added: %t, expires: %v", PLUGIN, fn, nick, hm.String(), added, expires)
+		})
 
-		err := _ops.SaveFile(_opfile)
-		if err != nil {
-			log.Error(err)
-		}
+		n.auditLater(channel, by, fmt.Sprintf("%s: Added %q (%s) to OPs list", PLUGIN, nick, hm.String()), err)
 
 		devdbg("%s: %s: Giving %q OP right away!", PLUGIN, fn, nick)
-		_conn.Mode(channel, "+o", nick) // try to OP right away
+		n.mode(channel, "+o", nick) // try to OP right away
 	}()
 
 	devdbg("%s: %s: Calling WHOIS on nick %q", PLUGIN, fn, nick)
-	_conn.Whois(nick)
+	n.whois(nick)
 
-	return fmt.Sprintf("%s: Adding %q to OPs list", PLUGIN, nick), nil
+	if ttl > 0 {
+		return fmt.Sprintf("%s: Adding %q to OPs list for %s", PLUGIN, nick, fmtDuration(ttl)), _errPending
+	}
+	return fmt.Sprintf("%s: Adding %q to OPs list", PLUGIN, nick), _errPending
 }
 
-func del(channel, nick string) (string, error) {
+// tempop parses the given duration and adds nick as a temporary OP
+func (n *Network) tempop(channel string, by origin, nick, duration string) (string, error) {
+	if nick == "" || duration == "" {
+		return fmt.Sprintf("%s: Usage: !op %s <nick> <duration>", PLUGIN, strings.ToLower(TEMPOP)), nil
+	}
+	ttl, err := parseDuration(duration)
+	if err != nil || ttl <= 0 {
+		return fmt.Sprintf("%s: Invalid duration %q, use e.g. 90m, 2h or 1d", PLUGIN, duration), nil
+	}
+	c := n.channel(channel)
+	if _, temporary := c.Expiry(nick); c.Has(nick) && !temporary {
+		return fmt.Sprintf("%s: %s is already a permanent OP, delete them first to make them temporary", PLUGIN, nick), nil
+	}
+	return n.add(channel, by, nick, ttl)
+}
+
+func (n *Network) del(channel string, by origin, nick string) (string, error) {
 	if nick == "" {
 		emsg := PLUGIN + ": Cannot delete empty nick"
 		return emsg, fmt.Errorf(emsg)
 	}
-	_ops.Get(channel).Remove(nick)
-	err := _ops.SaveFile(_opfile)
-	if err != nil {
-		log.Error(err)
-	}
-	_conn.Mode(channel, "-o", nick) // try to DEOP right away
+	_, err := change(n.key(channel), by, func(c *Channel) {
+		c.Remove(nick)
+	})
+	n.mode(channel, "-o", nick) // try to DEOP right away
 	return fmt.Sprintf("%s: Nick %q removed from OPs list", PLUGIN, nick), err
 }
 
-func wmsg(channel, action, msg string) (string, error) {
+func (n *Network) wmsg(channel string, by origin, action, msg string) (string, error) {
+	if match(action, MODE) {
+		return n.wmsgMode(channel, by, msg)
+	}
+	if match(action, COOLDOWN) {
+		return n.wmsgCooldown(channel, by, msg)
+	}
+
 	var err error
-	c := _ops.Get(channel)
+	c := n.channel(channel)
 	if match(action, "SET") {
-		c.Lock()
-		c.WelcomeMsg = msg
-		c.Unlock()
-		err = _ops.SaveFile(_opfile)
-		if err != nil {
-			log.Error(err)
+		if verr := ValidateWMsg(msg); verr != nil {
+			return fmt.Sprintf("%s: Invalid welcome message: %s", PLUGIN, verr.Error()), nil
 		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.WelcomeMsg = msg
+			c.Unlock()
+		})
+	}
+	if c.WelcomeMsg == "" && policy(n.key(channel)).WelcomeMsg != "" {
+		return fmt.Sprintf("%s: Welcome message for channel %s: %q (default)", PLUGIN, channel, policy(n.key(channel)).WelcomeMsg), err
 	}
 	return fmt.Sprintf(
 		"%s: Welcome message for channel %s: %q",
@@ -264,8 +493,386 @@ func wmsg(channel, action, msg string) (string, error) {
 	), err
 }
 
-func mask(channel, action, nick, hostmask string) (retmsg string, err error) {
-	c := _ops.Get(channel)
+// wmsgMode shows or sets how welcome messages are sent in channel
+func (n *Network) wmsgMode(channel string, by origin, mode string) (string, error) {
+	var err error
+	c := n.channel(channel)
+
+	if mode != "" {
+		mode = strings.ToLower(mode)
+		if !ValidWMode(mode) {
+			return fmt.Sprintf("%s: Usage: !op %s %s <%s|%s|%s>", PLUGIN, strings.ToLower(WMSG), strings.ToLower(MODE), WMODE_CHANNEL, WMODE_NOTICE, WMODE_PRIVATE), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.WelcomeMode = mode
+			c.Unlock()
+		})
+	}
+	return fmt.Sprintf("%s: Welcome messages in %s are sent as: %s", PLUGIN, channel, welcomeMode(n.key(channel), c)), err
+}
+
+// wmsgCooldown shows or sets how long to wait before welcoming the same nick again in channel
+func (n *Network) wmsgCooldown(channel string, by origin, duration string) (string, error) {
+	var err error
+	c := n.channel(channel)
+
+	if duration != "" {
+		d, perr := parseDuration(duration)
+		if perr != nil || d <= 0 {
+			return fmt.Sprintf("%s: Usage: !op %s %s <duration>, e.g. 10m or 1h", PLUGIN, strings.ToLower(WMSG), strings.ToLower(COOLDOWN)), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.WelcomeCooldown = Duration(d)
+			c.Unlock()
+		})
+	}
+	return fmt.Sprintf("%s: Nicks are welcomed at most once every %s in %s", PLUGIN, fmtDuration(welcomeCooldown(n.key(channel), c)), channel), err
+}
+
+// greet shows, sets or removes the caller's own welcome message. Any OP may remove the greeting of another.
+func (n *Network) greet(channel string, by origin, caller, action, arg string) (string, error) {
+	var err error
+	c := n.channel(channel)
+	usage := fmt.Sprintf("%s: Usage: !op %s <get [nick]|set <message>|del [nick]>", PLUGIN, strings.ToLower(GREET))
+
+	nick := arg
+	if nick == "" {
+		nick = caller
+	}
+
+	if match(action, GET) {
+		if msg := c.Greeting(nick); msg != "" {
+			return fmt.Sprintf("%s: Greeting for %q: %q", PLUGIN, nick, msg), nil
+		}
+		return fmt.Sprintf("%s: No greeting for %q", PLUGIN, nick), nil
+	}
+
+	if match(action, SET) {
+		if arg == "" {
+			return usage, nil
+		}
+		if !c.Has(caller) {
+			return fmt.Sprintf("%s: %s, only nicks in the OPs list can have a greeting", PLUGIN, caller), nil
+		}
+		if verr := ValidateWMsg(arg); verr != nil {
+			return fmt.Sprintf("%s: Invalid greeting: %s", PLUGIN, verr.Error()), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.SetGreeting(caller, arg)
+		})
+		return fmt.Sprintf("%s: Greeting for %q: %q", PLUGIN, caller, arg), err
+	}
+
+	if match(action, DEL) {
+		removed := false
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			removed = c.RemoveGreeting(nick)
+		})
+		if !removed {
+			return fmt.Sprintf("%s: No greeting for %q", PLUGIN, nick), nil
+		}
+		return fmt.Sprintf("%s: Greeting removed for %q", PLUGIN, nick), err
+	}
+
+	return usage, nil
+}
+
+// vmsg shows, sets or removes the welcome message for visitors in channel
+func (n *Network) vmsg(channel string, by origin, action, msg string) (string, error) {
+	var err error
+	c := n.channel(channel)
+	usage := fmt.Sprintf("%s: Usage: !op %s <get|set <message>|del|exclude <add|del|ls> [nick|hostmask]>", PLUGIN, strings.ToLower(VMSG))
+
+	if match(action, SET) {
+		if msg == "" {
+			return usage, nil
+		}
+		if verr := ValidateWMsg(msg); verr != nil {
+			return fmt.Sprintf("%s: Invalid welcome message: %s", PLUGIN, verr.Error()), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.VisitorMsg = msg
+			c.Unlock()
+		})
+	} else if match(action, DEL) {
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.VisitorMsg = ""
+			c.Unlock()
+		})
+	} else if !match(action, GET) {
+		return usage, nil
+	}
+
+	c.RLock()
+	msg = c.VisitorMsg
+	c.RUnlock()
+	if msg == "" && policy(n.key(channel)).VisitorMsg != "" {
+		return fmt.Sprintf("%s: Visitor welcome message for channel %s: %q (default)", PLUGIN, channel, policy(n.key(channel)).VisitorMsg), err
+	}
+	if msg == "" {
+		return fmt.Sprintf("%s: No visitor welcome message for channel %s", PLUGIN, channel), err
+	}
+	return fmt.Sprintf("%s: Visitor welcome message for channel %s: %q", PLUGIN, channel, msg), err
+}
+
+// vmsgExclude manages the nicks and hostmasks that don't get the visitor welcome message
+func (n *Network) vmsgExclude(channel string, by origin, action, entry string) (string, error) {
+	var err error
+	c := n.channel(channel)
+	usage := fmt.Sprintf("%s: Usage: !op %s %s <add|del|ls> [nick|hostmask]", PLUGIN, strings.ToLower(VMSG), strings.ToLower(EXCLUDE))
+
+	if match(action, LS) {
+		c.RLock()
+		masks := strings.Join(c.VisitorExclude, " ")
+		c.RUnlock()
+		return fmt.Sprintf("%s: Excluded from visitor welcome messages in %s: %s", PLUGIN, channel, masks), nil
+	}
+
+	if entry == "" {
+		return usage, nil
+	}
+	mask := ExcludeMask(entry)
+
+	if match(action, ADD) {
+		if !ValidMask(mask) {
+			return fmt.Sprintf("%s: Invalid hostmask %q, expected nick!user@host", PLUGIN, mask), nil
+		}
+		added := false
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			added = c.AddVisitorExclude(mask)
+		})
+		if !added {
+			return fmt.Sprintf("%s: %q is already excluded", PLUGIN, mask), nil
+		}
+		return fmt.Sprintf("%s: Excluded %q from visitor welcome messages", PLUGIN, mask), err
+	}
+
+	if match(action, DEL) {
+		removed := false
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			removed = c.RemoveVisitorExclude(mask)
+		})
+		if !removed {
+			return fmt.Sprintf("%s: %q is not excluded", PLUGIN, mask), nil
+		}
+		return fmt.Sprintf("%s: %q no longer excluded from visitor welcome messages", PLUGIN, mask), err
+	}
+
+	return usage, nil
+}
+
+// flood shows or changes the join-flood and clone limits for channel, or lifts the measures taken
+func (n *Network) flood(channel string, by origin, action, setting string, values []string) (string, error) {
+	var err error
+	c := n.channel(channel)
+	usage := fmt.Sprintf(
+		"%s: Usage: !op %s <get|off|lift|set <joins <n> <window>|clones <n>|actions <ban|alert|+mode>...|lift <duration>>>",
+		PLUGIN,
+		strings.ToLower(FLOOD),
+	)
+	value := func(i int) string {
+		if i < len(values) {
+			return values[i]
+		}
+		return ""
+	}
+
+	if match(action, LIFT) {
+		now := time.Now()
+		err = changeLifts(n.key(channel), func(c *Channel) {
+			c.Lock()
+			for _, tm := range c.Lifts {
+				if tm.Until.After(now) {
+					tm.Until = now
+				}
+			}
+			c.Unlock()
+		})
+		n.floods.reset(channel)
+		liftModes(now)
+		return fmt.Sprintf("%s: Lifted flood measures in %s", PLUGIN, channel), err
+	}
+
+	if match(action, OFF) {
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.Flood = &FloodLimits{}
+			c.Unlock()
+		})
+	} else if match(action, SET) {
+		f := FloodLimits{}
+		if cur := floodLimits(n.key(channel), c); cur != nil {
+			f = *cur
+			f.Actions = append([]string{}, cur.Actions...)
+		}
+		switch strings.ToLower(setting) {
+		case "joins":
+			joins, window, perr := parseFloodJoins(value(0), value(1))
+			if perr != nil {
+				return fmt.Sprintf("%s: %s", PLUGIN, perr.Error()), nil
+			}
+			f.Joins, f.Window = joins, Duration(window)
+		case "clones":
+			clones, perr := strconv.Atoi(value(0))
+			if perr != nil || clones < 0 {
+				return fmt.Sprintf("%s: Invalid number of clones %q", PLUGIN, value(0)), nil
+			}
+			f.Clones = clones
+		case "actions":
+			f.Actions = make([]string, 0, len(values))
+			for _, v := range values {
+				f.Actions = append(f.Actions, strings.Split(strings.ToLower(v), ",")...)
+			}
+		case "lift":
+			d, perr := parseDuration(value(0))
+			if perr != nil || d <= 0 {
+				return fmt.Sprintf("%s: Invalid duration %q, use e.g. 10m or 1h", PLUGIN, value(0)), nil
+			}
+			f.Lift = Duration(d)
+		default:
+			return usage, nil
+		}
+		if verr := f.Validate(); verr != nil {
+			return fmt.Sprintf("%s: %s", PLUGIN, verr.Error()), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.Flood = &f
+			c.Unlock()
+		})
+	} else if action != "" && !match(action, GET) {
+		return usage, nil
+	}
+
+	c.RLock()
+	own := c.Flood != nil
+	c.RUnlock()
+	f := floodLimits(n.key(channel), c)
+	if f == nil {
+		return fmt.Sprintf("%s: Flood limits for %s: off", PLUGIN, channel), err
+	}
+	if !own {
+		return fmt.Sprintf("%s: Flood limits for %s: %s (default)", PLUGIN, channel, f.String()), err
+	}
+	return fmt.Sprintf("%s: Flood limits for %s: %s", PLUGIN, channel, f.String()), err
+}
+
+// spam shows or changes the message flood and spam limits for channel
+func (n *Network) spam(channel string, by origin, action, setting string, values []string) (string, error) {
+	var err error
+	c := n.channel(channel)
+	usage := fmt.Sprintf(
+		"%s: Usage: !op %s <get|off|set <lines <n> <window>|repeats <n>|caps <percent>|mentions <n>|actions <warn|kick|ban>...|ban <duration>>>",
+		PLUGIN,
+		strings.ToLower(SPAM),
+	)
+	value := func(i int) string {
+		if i < len(values) {
+			return values[i]
+		}
+		return ""
+	}
+
+	if match(action, OFF) {
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.Spam = &SpamLimits{}
+			c.Unlock()
+		})
+	} else if match(action, SET) {
+		s := SpamLimits{}
+		if cur := spamLimits(n.key(channel), c); cur != nil {
+			s = *cur
+			s.Actions = append([]string{}, cur.Actions...)
+		}
+		var perr error
+		switch strings.ToLower(setting) {
+		case "lines":
+			s.Lines, perr = parseSpamCount("lines", value(0))
+			if perr == nil && value(1) != "" {
+				var w time.Duration
+				w, perr = parseDuration(value(1))
+				s.Window = Duration(w)
+			}
+		case "repeats":
+			s.Repeats, perr = parseSpamCount("repeats", value(0))
+		case "caps":
+			s.Caps, perr = parseSpamCount("caps", value(0))
+		case "mentions":
+			s.Mentions, perr = parseSpamCount("mentions", value(0))
+		case "actions":
+			s.Actions = make([]string, 0, len(values))
+			for _, v := range values {
+				s.Actions = append(s.Actions, strings.Split(strings.ToLower(v), ",")...)
+			}
+		case "ban":
+			var d time.Duration
+			d, perr = parseDuration(value(0))
+			if perr == nil && d <= 0 {
+				perr = fmt.Errorf("invalid duration %q, use e.g. 1h or 1d", value(0))
+			}
+			s.Ban = Duration(d)
+		default:
+			return usage, nil
+		}
+		if perr == nil {
+			perr = s.Validate()
+		}
+		if perr != nil {
+			return fmt.Sprintf("%s: %s", PLUGIN, perr.Error()), nil
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.Lock()
+			c.Spam = &s
+			c.Unlock()
+		})
+	} else if action != "" && !match(action, GET) {
+		return usage, nil
+	}
+
+	c.RLock()
+	own := c.Spam != nil
+	c.RUnlock()
+	s := spamLimits(n.key(channel), c)
+	if s == nil {
+		return fmt.Sprintf("%s: Spam limits for %s: off", PLUGIN, channel), err
+	}
+	if !own {
+		return fmt.Sprintf("%s: Spam limits for %s: %s (default)", PLUGIN, channel, s.String()), err
+	}
+	return fmt.Sprintf("%s: Spam limits for %s: %s", PLUGIN, channel, s.String()), err
+}
+
+func (n *Network) idle(channel string, by origin, action, duration string) (string, error) {
+	var err error
+	c := n.channel(channel)
+
+	if match(action, SET) {
+		var d time.Duration
+		if !match(duration, "OFF") {
+			d, err = parseDuration(duration)
+			if err != nil || d <= 0 {
+				return fmt.Sprintf("%s: Usage: !op %s set <duration|off>, e.g. 2w or 336h", PLUGIN, strings.ToLower(IDLE)), nil
+			}
+		}
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			c.SetIdleDeop(d)
+		})
+	}
+
+	d := idleTimeout(n.key(channel), c)
+	if d <= 0 {
+		return fmt.Sprintf("%s: Idle DEOP is off for %s", PLUGIN, channel), err
+	}
+	return fmt.Sprintf("%s: OPs idle for more than %s in %s will be DEOPed", PLUGIN, fmtDuration(d), channel), err
+}
+
+func (n *Network) mask(channel string, by origin, action, nick, hostmask string) (retmsg string, err error) {
+	c := n.channel(channel)
 	utmpl := []string{
 		fmt.Sprintf("%s: Usage: !op %s %%s <nick>", PLUGIN, MASK),
 		fmt.Sprintf("%s: Usage: !op %s %%s <nick> <hostmask>", PLUGIN, MASK),
@@ -273,15 +880,12 @@ func mask(channel, action, nick, hostmask string) (retmsg string, err error) {
 	dirty := false
 	retmsg = PLUGIN + ": Usage: !op mask <add|del|clear|ls> <nick> [hostmask]"
 
-	defer func() {
-		if !dirty {
-			return
-		}
-		err = _ops.SaveFile(_opfile)
-		if err != nil {
-			log.Error(err)
-		}
-	}()
+	// just a little helper to run the change through the journal
+	modify := func(fn func(c *Channel) bool) {
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			dirty = fn(c)
+		})
+	}
 
 	if match(action, LS) {
 		if nick == "" {
@@ -299,7 +903,7 @@ func mask(channel, action, nick, hostmask string) (retmsg string, err error) {
 			retmsg = fmt.Sprintf(utmpl[0], CLEAR)
 			return
 		}
-		dirty = c.ClearHostmasks(nick)
+		modify(func(c *Channel) bool { return c.ClearHostmasks(nick) })
 		if dirty {
 			retmsg = fmt.Sprintf("%s: Hostmasks cleared for %q", PLUGIN, nick)
 		} else {
@@ -313,7 +917,7 @@ func mask(channel, action, nick, hostmask string) (retmsg string, err error) {
 			retmsg = fmt.Sprintf(utmpl[1], ADD)
 			return
 		}
-		dirty = c.Add(nick, hostmask)
+		modify(func(c *Channel) bool { return c.Add(nick, hostmask) })
 		if dirty {
 			retmsg = fmt.Sprintf("%s: Added hostmask %q to nick %s", PLUGIN, hostmask, nick)
 		} else {
@@ -327,7 +931,7 @@ func mask(channel, action, nick, hostmask string) (retmsg string, err error) {
 			retmsg = fmt.Sprintf(utmpl[1], DEL)
 			return
 		}
-		dirty = c.RemoveHostmask(nick, hostmask)
+		modify(func(c *Channel) bool { return c.RemoveHostmask(nick, hostmask) })
 		if dirty {
 			retmsg = fmt.Sprintf("%s: Matching hostmask removed from %q", PLUGIN, nick)
 		} else {
@@ -339,34 +943,93 @@ func mask(channel, action, nick, hostmask string) (retmsg string, err error) {
 	return
 }
 
-func getOP(channel, nick string) (string, error) {
+func (n *Network) sched(channel string, by origin, action, nick, days, hours, tz string) (string, error) {
+	var err error
+	c := n.channel(channel)
+	usage := fmt.Sprintf("%s: Usage: !op %s <add|clear|ls> <nick> [<days> <hh:mm-hh:mm> [timezone]]", PLUGIN, strings.ToLower(SCHED))
+
+	if nick == "" {
+		return usage, nil
+	}
+	if !c.Has(nick) {
+		return fmt.Sprintf("%s: %q - no such nick", PLUGIN, nick), nil
+	}
+
+	if match(action, LS) {
+		windows := c.Schedule(nick)
+		if len(windows) == 0 {
+			return fmt.Sprintf("%s: %q has no schedule, and may hold OP at any time", PLUGIN, nick), nil
+		}
+		ws := make([]string, 0, len(windows))
+		for _, w := range windows {
+			ws = append(ws, w.String())
+		}
+		return fmt.Sprintf("%s: Schedule for %q: %s", PLUGIN, nick, strings.Join(ws, ", ")), nil
+	}
+
+	if match(action, CLEAR) {
+		cleared := false
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			cleared = c.ClearSchedule(nick)
+		})
+		if !cleared {
+			return fmt.Sprintf("%s: Nothing to clear for %q", PLUGIN, nick), nil
+		}
+		return fmt.Sprintf("%s: Schedule cleared for %q, may now hold OP at any time", PLUGIN, nick), err
+	}
+
+	if match(action, ADD) {
+		if days == "" || hours == "" {
+			return usage, nil
+		}
+		w, perr := ParseWindow(days, hours, tz)
+		if perr != nil {
+			return fmt.Sprintf("%s: %s", PLUGIN, perr.Error()), nil
+		}
+		added := false
+		_, err = change(n.key(channel), by, func(c *Channel) {
+			added = c.AddWindow(nick, w)
+		})
+		if !added {
+			return fmt.Sprintf("%s: %q already has window %q", PLUGIN, nick, w.String()), nil
+		}
+		return fmt.Sprintf("%s: Added window %q to schedule for %q", PLUGIN, w.String(), nick), err
+	}
+
+	return usage, nil
+}
+
+func (n *Network) getOP(channel, nick string) (string, error) {
 	const fn string = "getOP()"
 
 	go func() {
-		devdbg("%s: %s: Goroutine waiting to read from _wchan...", PLUGIN, fn)
-		hm := readWhois(_wcTimeout)
+		devdbg("%s: %s: Goroutine waiting to read from n.wchan...", PLUGIN, fn)
+		hm := n.readWhois(_wcTimeout)
 
 		if hm == nil {
-			devdbg("%s: %s: Got NIL hostmask back on _wchan. %q does not exist on server", PLUGIN, fn, nick)
+			devdbg("%s: %s: Got NIL hostmask back on n.wchan. %q does not exist on server", PLUGIN, fn, nick)
+			_mOPDenied.WithLabelValues("get", "whois").Inc()
 			return
 		}
 
 		devdbg("%s: %s: Got back info about nick %q: %#v", PLUGIN, fn, nick, hm)
 
-		if _ops.Get(channel).MatchHostMask(nick, hm.String()) {
+		c := n.channel(channel)
+		if c.MatchHostMask(nick, hm.String()) && !c.OnShift(nick, time.Now()) {
+			_mOPDenied.WithLabelValues("get", "off_shift").Inc()
+			n.Privmsg(channel, fmt.Sprintf("%s: Nick %q is off shift. No OP for you right now.", PLUGIN, nick))
+		} else if c.MatchHostMask(nick, hm.String()) {
 			devdbg("%s: %s: Nick %q has matching hostmask (%q), op'ing", PLUGIN, fn, nick, hm.String())
-			_conn.Mode(channel, "+o", nick) // try to OP right away
+			n.mode(channel, "+o", nick) // try to OP right away
+			_mOPGranted.WithLabelValues("get").Inc()
 		} else {
-			_bot.SendMessage(
-				channel,
-				fmt.Sprintf("%s: Nick %q has no hostmask matching %q. No OP for you.", PLUGIN, nick, hm.String()),
-				nil,
-			)
+			_mOPDenied.WithLabelValues("get", "hostmask").Inc()
+			n.Privmsg(channel, fmt.Sprintf("%s: Nick %q has no hostmask matching %q. No OP for you.", PLUGIN, nick, hm.String()))
 		}
 	}()
 
 	devdbg("%s: %s: Calling WHOIS on nick %q", PLUGIN, fn, nick)
-	_conn.Whois(nick)
+	n.whois(nick)
 
 	return "", nil
 }
@@ -381,7 +1044,62 @@ func op(cmd *bot.Cmd) (string, error) {
 		return PLUGIN + ": Arguments missing", nil
 	}
 
-	args := safeArgs(4, cmd.Args) // 4 is the longest possible set of valid args
+	n := networkFor(cmd)
+	if n == nil {
+		server := ""
+		if cmd.ChannelData != nil {
+			server = cmd.ChannelData.Server
+		}
+		return "", fmt.Errorf("%s: Not set up on the network of server %q", PLUGIN, server)
+	}
+
+	args := safeArgs(6, cmd.Args) // 6 is the longest possible set of valid args
+
+	if ok, first := n.allowCmd(cmd.User, args[0]); !ok {
+		devdbg("%s: %s: %q is over the command rate limit", PLUGIN, fn, cmd.User.Nick)
+		_mCommands.WithLabelValues(cmdLabel(args[0]), "limited").Inc()
+		if first {
+			return fmt.Sprintf("%s: %s, too many commands, ignoring you for a while", PLUGIN, cmd.User.Nick), nil
+		}
+		return "", nil
+	}
+
+	retmsg, err := n.runCmd(cmd, args)
+	result := "ok"
+	pending := err == _errPending
+	if pending {
+		err = nil
+	} else if err == _errDenied {
+		result, err = "denied", nil
+	} else if err != nil {
+		result = "error"
+	}
+	_mCommands.WithLabelValues(cmdLabel(args[0]), result).Inc()
+
+	if mutating(args[0], args[1]) {
+		a := &AuditEntry{
+			Time:    time.Now(),
+			Channel: n.key(cmd.Channel),
+			Network: n.Name,
+			Caller:  n.callerMask(cmd.User),
+			Command: strings.ToLower(args[0]),
+			Args:    cmd.Args[1:],
+			Result:  retmsg,
+		}
+		if pending {
+			a.Result = "pending"
+		}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		audit(a)
+	}
+
+	return retmsg, err
+}
+
+// runCmd checks if the caller is allowed to run the command, and runs it
+func (n *Network) runCmd(cmd *bot.Cmd, args []string) (string, error) {
 
 	// check if user is allowed to run this command (is in op list, or read-only command)
 	// Anyone is allowed anything if the list is empty
@@ -393,11 +1111,15 @@ func op(cmd *bot.Cmd) (string, error) {
 	// The calling nick can then:
 	// !op mask add <nick> <hostmask>
 	// !op get
-	if !okCmd(cmd.Channel, cmd.User.Nick, args[0], args[1]) {
-		return fmt.Sprintf("%s: %s, you must be in the OPs list to run this command", PLUGIN, cmd.User.Nick), nil
+	if !n.okCmd(cmd.Channel, cmd.User.Nick, args[0], args[1]) {
+		return fmt.Sprintf("%s: %s, you must be in the OPs list to run this command", PLUGIN, cmd.User.Nick), _errDenied
 	}
 
 	var retmsg string
+	by := origin{
+		Caller:  n.callerMask(cmd.User),
+		Command: strings.Join(cmd.Args, " "),
+	}
 
 	// just a little helper to shorten code later
 	arg := func(cmd string) bool {
@@ -405,22 +1127,77 @@ func op(cmd *bot.Cmd) (string, error) {
 	}
 
 	if arg(LS) {
-		return ls(cmd.Channel, args[1]), nil
+		return n.ls(cmd.Channel, args[1]), nil
 	} else if arg(ADD) {
-		return add(cmd.Channel, args[1])
+		if match(args[2], FOR) {
+			return n.tempop(cmd.Channel, by, args[1], args[3])
+		}
+		return n.add(cmd.Channel, by, args[1], 0)
+	} else if arg(TEMPOP) {
+		return n.tempop(cmd.Channel, by, args[1], args[2])
 	} else if arg(DEL) {
-		return del(cmd.Channel, args[1])
+		return n.del(cmd.Channel, by, args[1])
 	} else if arg(WMSG) {
-		return wmsg(cmd.Channel, args[1], strings.Join(cmd.Args[2:len(cmd.Args)], " "))
+		return n.wmsg(cmd.Channel, by, args[1], strings.Join(cmd.Args[2:len(cmd.Args)], " "))
+	} else if arg(GREET) {
+		if match(args[1], SET) {
+			return n.greet(cmd.Channel, by, cmd.User.Nick, args[1], strings.Join(cmd.Args[2:len(cmd.Args)], " "))
+		}
+		return n.greet(cmd.Channel, by, cmd.User.Nick, args[1], args[2])
+	} else if arg(VMSG) {
+		if match(args[1], EXCLUDE) {
+			return n.vmsgExclude(cmd.Channel, by, args[2], args[3])
+		}
+		return n.vmsg(cmd.Channel, by, args[1], strings.Join(cmd.Args[2:len(cmd.Args)], " "))
+	} else if arg(FLOOD) {
+		var values []string
+		if len(cmd.Args) > 3 {
+			values = cmd.Args[3:]
+		}
+		return n.flood(cmd.Channel, by, args[1], args[2], values)
+	} else if arg(SPAM) {
+		var values []string
+		if len(cmd.Args) > 3 {
+			values = cmd.Args[3:]
+		}
+		return n.spam(cmd.Channel, by, args[1], args[2], values)
+	} else if arg(KB) {
+		var rest []string
+		if len(cmd.Args) > 2 {
+			rest = cmd.Args[2:]
+		}
+		return n.kb(cmd.Channel, by, cmd.User.Nick, args[1], rest)
+	} else if arg(QUIET) {
+		return n.quiet(cmd.Channel, by, args[1], args[2])
+	} else if arg(UNQUIET) {
+		return n.unquiet(cmd.Channel, by, args[1])
+	} else if arg(MODELOCK) {
+		var lock string
+		if len(cmd.Args) > 2 {
+			lock = strings.Join(cmd.Args[2:], " ")
+		}
+		return n.modeLockCmd(cmd.Channel, by, args[1], lock)
+	} else if arg(BANMASK) {
+		return n.banMask(cmd.Channel, by, args[1], args[2])
 	} else if arg(MASK) {
-		return mask(cmd.Channel, args[1], args[2], args[3])
+		return n.mask(cmd.Channel, by, args[1], args[2], args[3])
+	} else if arg(IDLE) {
+		return n.idle(cmd.Channel, by, args[1], args[2])
+	} else if arg(SCHED) {
+		return n.sched(cmd.Channel, by, args[1], args[2], args[3], args[4], args[5])
+	} else if arg(UNDO) {
+		return undo(n.key(cmd.Channel), by, args[1])
 	} else if arg(GET) {
-		return getOP(cmd.Channel, cmd.User.Nick)
+		return n.getOP(cmd.Channel, cmd.User.Nick)
+	} else if arg(LOG) {
+		return auditLog(n.key(cmd.Channel), args[1])
 	} else if arg(RELOAD) {
-		reload()
+		if err := Reload(); err != nil {
+			return fmt.Sprintf("%s: Unable to reload OPs DB: %s", PLUGIN, err.Error()), nil
+		}
 		retmsg = PLUGIN + ": OPs DB reloaded"
 	} else if arg(CLEAR) {
-		clear()
+		clear(n.Namespace, by)
 		retmsg = PLUGIN + ": OPs DB cleared"
 	}
 
@@ -1,9 +1,41 @@
 package opbot
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-chat-bot/bot"
+	"github.com/go-chat-bot/bot/irc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	ircevent "github.com/thoj/go-ircevent"
 )
 
+// testOPs points _opfile at an empty temp file and _ops at new data, and returns
+// a func for defer that removes the file and puts back _opfile, _ops, _auditfile
+// and _networks as they were.
+func testOPs(t *testing.T) func() {
+	opfile, ops, auditfile, networks := _opfile, _ops, _auditfile, _networks
+	f, err := ioutil.TempFile("", "opbot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	_opfile = f.Name()
+	_ops = NewOPData()
+	_auditfile = ""
+	return func() {
+		os.Remove(f.Name())
+		_opfile, _ops, _auditfile, _networks = opfile, ops, auditfile, networks
+	}
+}
+
 func TestMatchMask(t *testing.T) {
 	mask1 := "oddee!~Oddlid@192.168.3.17"
 	rxs := []string{
@@ -23,3 +55,1027 @@ func TestMatchMask(t *testing.T) {
 		t.Errorf("Should not match")
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90m":   90 * time.Minute,
+		"2h":    2 * time.Hour,
+		"1d":    24 * time.Hour,
+		"1d12h": 36 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"1w1d":  8 * 24 * time.Hour,
+	}
+	for in, want := range tests {
+		got, err := parseDuration(in)
+		if err != nil {
+			t.Errorf("parseDuration(%q) error: %v", in, err)
+		}
+		if got != want {
+			t.Errorf("parseDuration(%q) = %v, want %v", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "d", "xd", "2x", "w1d"} {
+		if _, err := parseDuration(in); err == nil {
+			t.Errorf("parseDuration(%q) should fail", in)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	c := NewOPData().Get("#chan")
+	c.Add("perm", "perm!*@*")
+	c.Add("temp", "temp!*@*")
+	c.SetExpiry("temp", now.Add(time.Hour))
+
+	if _, found := c.Expiry("perm"); found {
+		t.Errorf("perm should not have an expiry")
+	}
+	if len(c.Expired(now)) != 0 {
+		t.Errorf("Nothing should have expired yet")
+	}
+	expired := c.Expired(now.Add(2 * time.Hour))
+	if len(expired) != 1 || expired[0] != "temp" {
+		t.Errorf("Expected temp to have expired, got: %v", expired)
+	}
+	c.Remove("temp")
+	if _, found := c.Expiry("temp"); found {
+		t.Errorf("Expiry should be removed along with the nick")
+	}
+
+	defer testOPs(t)()
+	n := &Network{Name: "test"}
+	nc := n.channel("#chan")
+	nc.Add("perm", "perm!*@*")
+	nc.Add("gone", "gone!*@*")
+	nc.SetExpiry("gone", now.Add(-time.Minute))
+	if msg := n.ls("#chan", ""); strings.Contains(msg, "gone") {
+		t.Errorf("Expected expired entries to be left out, got %q", msg)
+	}
+	if msg := n.ls("#chan", "gone"); !strings.Contains(msg, "NOT") {
+		t.Errorf("Expected an expired entry not to be registered, got %q", msg)
+	}
+	if msg, _ := n.tempop("#chan", origin{}, "perm", "1h"); !strings.Contains(msg, "permanent") {
+		t.Errorf("Expected tempop on a permanent OP to be refused, got %q", msg)
+	}
+	if _, found := nc.Expiry("perm"); found {
+		t.Errorf("Expected perm to stay permanent")
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	w, err := ParseWindow("mon-fri", "08:00-16:00", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2019-02-11 was a Monday
+	tests := map[string]bool{
+		"2019-02-11T08:00:00Z": true,
+		"2019-02-11T15:59:00Z": true,
+		"2019-02-11T16:00:00Z": false,
+		"2019-02-11T07:59:00Z": false,
+		"2019-02-16T12:00:00Z": false, // Saturday
+	}
+	for ts, want := range tests {
+		tm, _ := time.Parse(time.RFC3339, ts)
+		if w.Active(tm) != want {
+			t.Errorf("%s active at %s: expected %t", w, ts, want)
+		}
+	}
+
+	// Night shift starting friday evening, should still be active early saturday
+	w, _ = ParseWindow("fri", "22:00-06:00", "UTC")
+	tm, _ := time.Parse(time.RFC3339, "2019-02-16T05:00:00Z")
+	if !w.Active(tm) {
+		t.Errorf("%s should be active at %s", w, tm)
+	}
+	tm, _ = time.Parse(time.RFC3339, "2019-02-11T05:00:00Z")
+	if w.Active(tm) {
+		t.Errorf("%s should not be active at %s", w, tm)
+	}
+
+	for _, bad := range [][]string{{"xyz", "08:00-16:00"}, {"mon", "08:00"}, {"mon", "08:00-08:00"}, {"mon", "8-16"}} {
+		if _, err := ParseWindow(bad[0], bad[1], ""); err == nil {
+			t.Errorf("ParseWindow(%q, %q) should fail", bad[0], bad[1])
+		}
+	}
+}
+
+func TestShiftChanges(t *testing.T) {
+	defer testOPs(t)()
+	c := _ops.Get("#chan")
+	c.Add("Nick1", "Nick1!*@*")
+	w, _ := ParseWindow("mon-sun", "00:00-23:59", "UTC")
+	c.AddWindow("Nick1", w)
+
+	now := time.Now()
+	shiftChanges(now)
+	if _, known := _shifts.on["#chan Nick1"]; !known {
+		t.Errorf("Expected the shift of Nick1 to be remembered")
+	}
+	c.ClearSchedule("Nick1")
+	shiftChanges(now)
+	if _, known := _shifts.on["#chan Nick1"]; known {
+		t.Errorf("Expected the shift of Nick1 to be forgotten along with the schedule")
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	changes := parseModes("+ol-v+n", []string{"nick1", "10", "nick2"}, _defModeParams)
+	want := []modeChange{
+		{true, 'o', "nick1"},
+		{true, 'l', "10"},
+		{false, 'v', "nick2"},
+		{true, 'n', ""},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %d", len(want), len(changes))
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], changes[i])
+		}
+	}
+
+	// modes with parameters the defaults don't know of, from the server's 005
+	is := newISupport()
+	is.parse([]string{"CHANMODES=eIbq,k,flj,CFLMPQScgimnprstuz", "PREFIX=(ov)@+"})
+	for _, tc := range []struct {
+		modes  string
+		params []string
+		want   []modeChange
+	}{
+		{"+ntfk", []string{"#overflow", "key"}, []modeChange{{true, 'n', ""}, {true, 't', ""}, {true, 'f', "#overflow"}, {true, 'k', "key"}}},
+		{"+jo", []string{"3:10", "nick"}, []modeChange{{true, 'j', "3:10"}, {true, 'o', "nick"}}},
+		{"-fk", []string{"key"}, []modeChange{{false, 'f', ""}, {false, 'k', "key"}}},
+	} {
+		changes := parseModes(tc.modes, tc.params, is.modeParams())
+		if !reflect.DeepEqual(changes, tc.want) {
+			t.Errorf("Expected %+v from %s %v, got %+v", tc.want, tc.modes, tc.params, changes)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	c := &Channel{IdleDeop: Duration(336 * time.Hour)}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := &Channel{}
+	if err := json.Unmarshal(b, c2); err != nil {
+		t.Fatal(err)
+	}
+	if c2.GetIdleDeop() != 336*time.Hour {
+		t.Errorf("Expected %v, got %v (%s)", 336*time.Hour, c2.GetIdleDeop(), b)
+	}
+	if err := json.Unmarshal([]byte(`{"idle_deop":"2d"}`), c2); err != nil || c2.GetIdleDeop() != 48*time.Hour {
+		t.Errorf("Expected 48h, got %v, err: %v", c2.GetIdleDeop(), err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	input := `{"time":"2019-02-21T17:20:00Z","channel":"#chan","caller":"Oddlid!~odd@host","command":"add","args":["Nick1"],"result":"OPBot: Adding \"Nick1\" to OPs list"}
+not json
+{"time":"2019-02-21T17:21:00Z","channel":"#other","caller":"Someone!~some@host","command":"del","args":["Nick1"],"result":"OPBot: Nick \"Nick1\" removed from OPs list"}
+{"time":"2019-02-21T17:22:00Z","channel":"#chan","caller":"Oddlid!~odd@host","command":"mask","args":["clear","Nick1"],"result":"OPBot: Hostmasks cleared for \"Nick1\""}
+`
+	entries, err := ReadAudit(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if res := FilterAudit(entries, "#chan", "", 0); len(res) != 2 {
+		t.Errorf("Expected 2 entries for #chan, got %d", len(res))
+	}
+	if res := FilterAudit(entries, "", "someone", 0); len(res) != 1 || res[0].Command != "del" {
+		t.Errorf("Expected 1 entry for Someone, got %v", res)
+	}
+	res := FilterAudit(entries, "", "", 1)
+	if len(res) != 1 || res[0].Command != "mask" {
+		t.Errorf("Expected only the last entry, got %v", res)
+	}
+	want := `2019-02-21 17:22 #chan Oddlid!~odd@host: mask clear Nick1 => Hostmasks cleared for "Nick1"`
+	if res[0].String() != want {
+		t.Errorf("Expected %q, got %q", want, res[0].String())
+	}
+
+	defer testOPs(t)()
+	_auditfile = "/nonexistent/opbot-audit.log"
+	if msg, err := auditLog("#chan", ""); err != nil || !strings.Contains(msg, "No audit log entries") {
+		t.Errorf("Expected a missing audit log to be empty, got %q: %v", msg, err)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	defer testOPs(t)()
+
+	by := origin{Caller: "Oddlid!~odd@host", Command: "test"}
+	change("#chan", by, func(c *Channel) { c.Add("Nick1", "Nick1!*@*") })
+	change("#chan", by, func(c *Channel) { c.Add("Nick2", "Nick2!*@*") })
+	cs, _ := change("#chan", by, func(c *Channel) { c.Remove("Nick1") })
+	if cs == nil || len(cs.Changes) != 1 || cs.Changes[0].Key != "ops/Nick1" {
+		t.Fatalf("Unexpected change set: %+v", cs)
+	}
+	if cs, _ := change("#chan", by, func(c *Channel) {}); cs != nil {
+		t.Errorf("Expected no change set when nothing changed, got: %+v", cs)
+	}
+
+	// undo the removal of Nick1
+	undo("#chan", by, "")
+	c := _ops.Get("#chan")
+	if !c.Has("Nick1") || !c.Has("Nick2") {
+		t.Errorf("Expected both nicks after undo, got: %v", c.Nicks())
+	}
+
+	// undo adding Nick1, which should leave Nick2 alone
+	undo("#chan", by, "1")
+	if c.Has("Nick1") || !c.Has("Nick2") {
+		t.Errorf("Expected only Nick2 after undo, got: %v", c.Nicks())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	o := NewOPData()
+	c := o.Get("#chan")
+	c.Add("Nick1", "Nick1!*@*")
+	c.Add("Nick2", "bad")
+	c.SetExpiry("Nick3", time.Now())
+	o.Get("nochan")
+
+	errs := o.Validate()
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 errors, got: %v", errs)
+	}
+}
+
+func TestCSVAndMerge(t *testing.T) {
+	o := NewOPData()
+	c := o.Get("#chan")
+	c.Add("Nick1", "Nick1!*@*.one.com")
+	c.Add("Nick1", "Nick1!*@*.two.com")
+	w, _ := ParseWindow("mon-fri", "08:00-16:00", "UTC")
+	c.AddWindow("Nick1", w)
+	c.SetExpiry("Nick1", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	var sb strings.Builder
+	if err := o.WriteCSV(&sb); err != nil {
+		t.Fatal(err)
+	}
+	o2, err := ReadCSV(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := o.Diff(o2); len(d) != 0 {
+		t.Errorf("Expected no diff after CSV round trip, got: %v", d)
+	}
+
+	src := NewOPData()
+	sc := src.Get("#chan")
+	sc.Add("Nick1", "Nick1!*@*.three.com")
+	sc.Add("Nick2", "Nick2!*@*")
+	sc.WelcomeMsg = "Hi"
+	c.WelcomeMsg = "Hello"
+	conflicts := o.Merge(src)
+	if len(conflicts) != 1 {
+		t.Errorf("Expected 1 conflict, got: %v", conflicts)
+	}
+	if len(c.Hostmasks("Nick1")) != 3 || !c.Has("Nick2") || c.WelcomeMsg != "Hello" {
+		t.Errorf("Unexpected result of merge: %+v", c.OPs)
+	}
+
+	// every channel setting should survive an export and a merge into an empty DB
+	full := NewOPData()
+	fc := full.Get("#full")
+	fc.WelcomeMsg = "Hi"
+	fc.Add("Nick1", "Nick1!*@*")
+	fc.SetExpiry("Nick1", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	fc.AddWindow("Nick1", w)
+	fc.IdleDeop = Duration(time.Hour)
+	fc.AddVoice("Nick2", "Nick2!*@*")
+	fc.Greetings = map[string]string{"Nick1": "Hi all"}
+	fc.WelcomeMode = WMODE_NOTICE
+	fc.WelcomeCooldown = Duration(time.Hour)
+	fc.VisitorMsg = "Welcome"
+	fc.VisitorExclude = []string{"*!*@bots.example.com"}
+	fc.Flood = &FloodLimits{Joins: 3, Window: Duration(time.Minute)}
+	fc.Lifts = []*TimedMode{{Mode: "+i", Until: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), Network: "test"}}
+	fc.Spam = &SpamLimits{Lines: 5, Window: Duration(time.Minute)}
+	fc.BanMask = "*!*@host"
+	fc.ModeLock = "+nt"
+	fv := reflect.ValueOf(fc).Elem()
+	for i := 0; i < fv.NumField(); i++ {
+		if f := fv.Field(i); !fv.Type().Field(i).Anonymous && reflect.DeepEqual(f.Interface(), reflect.Zero(f.Type()).Interface()) {
+			t.Errorf("Channel field %s is not set in the test", fv.Type().Field(i).Name)
+		}
+	}
+	sb.Reset()
+	if err := full.WriteYAML(&sb); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ReadYAML(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := NewOPData()
+	if conflicts := merged.Merge(exported); len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts merging into an empty DB, got: %v", conflicts)
+	}
+	if d := full.Diff(merged); len(d) != 0 {
+		t.Errorf("Expected no diff after export and merge, got: %v", d)
+	}
+	exported.Get("#full").BanMask = "*!ident@*.domain"
+	if conflicts := merged.Merge(exported); len(conflicts) != 1 || !strings.Contains(conflicts[0], "ban_mask") {
+		t.Errorf("Expected a ban mask conflict, got: %v", conflicts)
+	}
+}
+
+func TestImporters(t *testing.T) {
+	userfile := `#4v: eggdrop v1.8.4 -- Bot -- written Mon Jan  1 00:00:00 2024
+Bot2       - bfo
+--HOSTS *!bot@bot.host.com
+oddlid     - hjlmnoptx
+--HOSTS -telnet!*@*
+--HOSTS *!~oddlid@*.server.com
+! #chan1          1700000000 -
+voicy      - -
+--HOSTS voicy!*@*.voice.com
+! #chan1          1700000000 v
+! #chan2          1700000000 qv
+::#chan2 bans
+- *!*@bad.host:+0:+1700000000:1700000000:oddlid:Go away
+`
+	o, err := ReadEggdrop(strings.NewReader(userfile), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := o.Get("#chan1"), o.Get("#chan2")
+	if !c1.MatchHostMask("oddlid", "oddlid!~oddlid@x.server.com") || !c2.Has("oddlid") {
+		t.Errorf("Expected oddlid to get OP in both channels, got: %+v, %+v", c1.OPs, c2.OPs)
+	}
+	if c1.Has("Bot2") || len(c1.Hostmasks("oddlid")) != 1 {
+		t.Errorf("Expected bots and telnet hosts to be skipped, got: %+v", c1.OPs)
+	}
+	if !c1.MatchVoice("voicy", "voicy!v@a.voice.com") || c1.Has("voicy") || c2.MatchVoice("voicy", "voicy!v@a.voice.com") {
+		t.Errorf("Expected voicy to get voice in #chan1 only, got: %+v, %+v", c1.Voices, c2.Voices)
+	}
+
+	listing := `-ChanServ- Entry Nickname/Host          Flags
+-ChanServ- ----- ---------------------- -----
+-ChanServ- 1     founder                +AFRefiorstv [modified 1 year ago]
+-ChanServ- 2     helper!*@*.help.com    +V [modified 2 weeks ago]
+-ChanServ- 3     *!*@*.wild.com         +O
+-ChanServ- 4     banned                 +b
+-ChanServ- ----- ---------------------- -----
+-ChanServ- End of #chan3 FLAGS listing.
+`
+	o, err = ReadChanServ(strings.NewReader(listing), "", "%s!*@user/%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3 := o.Get("#chan3")
+	if !c3.MatchHostMask("founder", "founder!f@user/founder") {
+		t.Errorf("Expected founder with mask from template, got: %+v", c3.OPs)
+	}
+	if !c3.MatchVoice("helper", "helper!h@x.help.com") || len(c3.OPs) != 1 {
+		t.Errorf("Unexpected result of ChanServ import: %+v, %+v", c3.OPs, c3.Voices)
+	}
+
+	anope := "Access list for #chan4:\n  Number   Level   Mask\n  1        10000   boss!*@boss.com\n  2        3       voice!*@v.com\n"
+	o, err = ReadChanServ(strings.NewReader(anope), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c4 := o.Get("#chan4"); !c4.Has("boss") || !c4.MatchVoice("voice", "voice!a@v.com") {
+		t.Errorf("Unexpected result of Anope import: %+v, %+v", c4.OPs, c4.Voices)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	defer testOPs(t)()
+
+	h := APIHandler("secret")
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/api/channels", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got: %d", rec.Code)
+	}
+	req := httptest.NewRequest("GET", "/api/channels", nil)
+	req.Header.Set("Authorization", "secret")
+	unauth := httptest.NewRecorder()
+	h.ServeHTTP(unauth, req)
+	if unauth.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the token but no Bearer, got: %d", unauth.Code)
+	}
+	if rec := do("PUT", "/api/channels/%23chan/users/Nick1", "secret", `{"hostmasks": ["bad"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid hostmask, got: %d", rec.Code)
+	}
+	for _, nick := range []string{"%20", "Nick%201", "Nick1%21%2A%40%2A", "a,b"} {
+		if rec := do("PUT", "/api/channels/%23chan/users/"+nick, "secret", `{"hostmasks": ["Nick1!*@*"]}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for invalid nick %q, got: %d", nick, rec.Code)
+		}
+	}
+	if rec := do("PUT", "/api/channels/chan/users/Nick1", "secret", `{"hostmasks": ["Nick1!*@*.one.com"]}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 when adding user, got: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("POST", "/api/channels/%23chan/users/Nick1/masks", "secret", `{"hostmask": "Nick1!*@*.two.com"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 when adding mask, got: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("DELETE", "/api/channels/%23chan/users/Nick1/masks/Nick1%21%2A%40%2A.one.com", "secret", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 when removing mask, got: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := do("GET", "/api/channels/%23chan/users/Nick1", "secret", "")
+	u := apiUser{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Hostmasks) != 1 || u.Hostmasks[0] != "Nick1!*@*.two.com" {
+		t.Errorf("Unexpected user: %+v", u)
+	}
+	if len(changeSets("#chan")) < 3 {
+		t.Errorf("Expected API changes to be journaled")
+	}
+	if rec := do("DELETE", "/api/channels/%23chan/users/Nick2", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown user, got: %d", rec.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	defer testOPs(t)()
+	_ops.Get("#chan").Add("Nick1", "Nick1!*@*")
+	mask := _mCommands.WithLabelValues("mask", "ok")
+	unknown := _mCommands.WithLabelValues("unknown", "ok")
+	masks, unknowns := testutil.ToFloat64(mask), testutil.ToFloat64(unknown)
+	_mCommands.WithLabelValues(cmdLabel("Mask"), "ok").Inc()
+	_mCommands.WithLabelValues(cmdLabel("junk"), "ok").Inc()
+	if testutil.ToFloat64(mask) != masks+1 || testutil.ToFloat64(unknown) != unknowns+1 {
+		t.Errorf("Expected Mask and junk to be counted once each as mask and unknown")
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`opbot_users{channel="#chan"} 1`,
+		`opbot_masks{channel="#chan"} 1`,
+		`opbot_commands_total{command="mask",result="ok"}`,
+		`opbot_commands_total{command="unknown",result="ok"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics", want)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	h := &Health{
+		Connected: true,
+		DBLoaded:  true,
+		Channels:  []ChannelStatus{{Name: "#chan", Joined: true}, {Name: "#other"}},
+	}
+	if !h.Healthy() || h.Ready() {
+		t.Errorf("Expected healthy but not ready when not in all channels")
+	}
+	h.Channels[1].Joined = true
+	if !h.Ready() {
+		t.Errorf("Expected ready when in all channels")
+	}
+	h.DBLoaded = false
+	if h.Ready() {
+		t.Errorf("Expected not ready when the OPs file failed to load")
+	}
+
+	o := NewOPData().LoadFile("/nonexistent/opbot.json")
+	if o.LoadError() != nil {
+		t.Errorf("Expected missing OPs file to not be an error, got: %v", o.LoadError())
+	}
+	bad, err := ioutil.TempFile("", "opbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.WriteString("{not json")
+	bad.Close()
+	defer os.Remove(bad.Name())
+	o = NewOPData().LoadFile(bad.Name())
+	if o.LoadError() == nil || o.Changed(bad.Name()) {
+		t.Errorf("Expected a broken OPs file to fail to load once, and not again until changed")
+	}
+
+	rec := httptest.NewRecorder()
+	HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when not connected, got: %d", rec.Code)
+	}
+
+	// channels in the config may be written in another case than the server uses
+	r := NewRoster()
+	r.Join("#chan", "opbot", "opbot!bot@host")
+	if r.Get("#Chan", "opbot") == nil || r.Get("#other", "opbot") != nil {
+		t.Errorf("Expected the bot to be found in #Chan, and only there")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer testOPs(t)()
+	_ops.Get("#chan").Add("Nick1", "Nick1!*@*")
+	if err := _ops.SaveFile("/nonexistent/opbot.json"); err == nil || !_ops.Unsaved() {
+		t.Fatalf("Expected failed save to be remembered")
+	}
+
+	_changeMu.Lock()
+	defer _changeMu.Unlock()
+	if err := shutdown("bye"); err != nil || _ops.Unsaved() {
+		t.Errorf("Expected Shutdown to retry the failed save, got: %v", err)
+	}
+	if NewOPData().LoadFile(_opfile).Get("#chan").Has("Nick1") == false {
+		t.Errorf("Expected the OPs file to be saved on shutdown")
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	for _, key := range []string{"#chan", "libera/#chan", "libera/#a/b"} {
+		if ns, ch := SplitKey(key); Key(ns, ch) != key {
+			t.Errorf("Expected %q back, got %q", key, Key(ns, ch))
+		}
+	}
+	if ns, ch := SplitKey("libera/#chan"); ns != "libera" || ch != "#chan" {
+		t.Errorf("Unexpected split: %q %q", ns, ch)
+	}
+
+	oftc := &Network{Name: "oftc", Config: &irc.Config{Server: "irc.oftc.net:6697"}}
+	libera := &Network{Name: "libera", Namespace: "libera", Config: &irc.Config{Server: "irc.libera.chat:6697"}}
+	defer testOPs(t)()
+	_networks = []*Network{oftc, libera}
+
+	cmd := &bot.Cmd{ChannelData: &bot.ChannelData{Server: "irc.libera.chat:6697"}}
+	if networkFor(cmd) != libera {
+		t.Errorf("Expected command to come from libera")
+	}
+	if networkFor(&bot.Cmd{ChannelData: &bot.ChannelData{Server: "irc.example.net:6697"}}) != nil {
+		t.Errorf("Expected no network for a command from an unknown server")
+	}
+	dup := func(name string) *Network {
+		return &Network{Name: name, Bot: &bot.Bot{}, Config: &irc.Config{Server: "irc.oftc.net:6697"}, Conn: ircevent.IRC("opbot", "opbot")}
+	}
+	if err := InitNetworks("", dup("one"), dup("two")); err == nil || !strings.Contains(err.Error(), "used by another network") {
+		t.Errorf("Expected networks on the same server to be refused, got: %v", err)
+	}
+	if nets, ch := networksFor("libera/#chan"); len(nets) != 1 || nets[0] != libera || ch != "#chan" {
+		t.Errorf("Unexpected networks for libera/#chan: %v %q", nets, ch)
+	}
+
+	oftc.channel("#chan").Add("Nick1", "Nick1!*@*")
+	libera.channel("#chan").Add("Nick2", "Nick2!*@*")
+	if _ops.Get("#chan").Has("Nick2") || !_ops.Get("libera/#chan").Has("Nick2") {
+		t.Errorf("Expected namespaces to be kept apart")
+	}
+	if errs := _ops.Validate(); len(errs) != 0 {
+		t.Errorf("Expected namespaced channels to be valid, got: %v", errs)
+	}
+	if err := _ops.SaveFile(_opfile); err != nil {
+		t.Fatal(err)
+	}
+
+	clear(libera.Namespace, origin{Caller: "test"})
+	if !_ops.Get("#chan").Has("Nick1") || !libera.channel("#chan").Empty() {
+		t.Errorf("Expected clear to only clear the network's own namespace")
+	}
+}
+
+func TestWelcomeMsg(t *testing.T) {
+	d := &WelcomeData{Nick: "Nick1", Channel: "#chan", Users: 3, LastSeen: time.Now().Add(-2 * time.Hour)}
+	tests := map[string]string{
+		"Welcome, %s":  "Welcome, Nick1",
+		"":             "",
+		"Hi {{.Nick}}": "Hi Nick1",
+		"{{upper .Nick}} back after {{ago .LastSeen}},\n {{.Users}} in {{.Channel}}": "NICK1 back after 2h, 3 in #chan",
+	}
+	for msg, expected := range tests {
+		if got, err := RenderWMsg(msg, d); err != nil || got != expected {
+			t.Errorf("Expected %q for %q, got %q, %v", expected, msg, got, err)
+		}
+	}
+	if got, _ := RenderWMsg("{{ago .LastSeen}}", &WelcomeData{}); got != "never" {
+		t.Errorf("Expected never seen, got %q", got)
+	}
+
+	for _, msg := range []string{"Hi {{.Nik}}", "Hi {{.Nick", "{{nope .Nick}}"} {
+		err := ValidateWMsg(msg)
+		if err == nil {
+			t.Errorf("Expected %q to be invalid", msg)
+		} else if strings.Contains(err.Error(), "wmsg") {
+			t.Errorf("Expected the error to be shortened, got: %s", err.Error())
+		}
+	}
+}
+
+func TestGreetings(t *testing.T) {
+	c := newChannel()
+	c.WelcomeMsg = "Welcome, {{.Nick}}"
+	c.Add("Nick1", "Nick1!*@*")
+	c.SetGreeting("Nick1", "{{.Nick}} has arrived")
+	if msg := welcomeMsg("#chan", c, &WelcomeData{Nick: "Nick1"}); msg != "Nick1 has arrived" {
+		t.Errorf("Expected the nick's own greeting, got %q", msg)
+	}
+	if msg := welcomeMsg("#chan", c, &WelcomeData{Nick: "Nick2"}); msg != "Welcome, Nick2" {
+		t.Errorf("Expected the channel's welcome message, got %q", msg)
+	}
+	c.Remove("Nick1")
+	if c.Greeting("Nick1") != "" {
+		t.Errorf("Expected the greeting to be removed with the nick")
+	}
+
+	if welcomeMode("#chan", c) != WMODE_CHANNEL || welcomeCooldown("#chan", c) != DEF_WMSG_COOLDOWN {
+		t.Errorf("Expected default mode and cooldown")
+	}
+	SetPolicy("#chan", Policy{WelcomeMode: WMODE_NOTICE})
+	defer SetPolicy("#chan", Policy{})
+	if welcomeMode("#chan", c) != WMODE_NOTICE {
+		t.Errorf("Expected mode from the policy")
+	}
+
+	r := NewRoster()
+	if !r.Greet("#chan", "Nick1", time.Hour) || r.Greet("#chan", "Nick1", time.Hour) {
+		t.Errorf("Expected to welcome Nick1 only once an hour")
+	}
+	if !r.Greet("#other", "Nick1", time.Hour) || !r.Greet("#chan", "Nick1", 0) {
+		t.Errorf("Expected cooldown to be per channel and duration")
+	}
+
+	r.Join("#chan", "Gone", "Gone!user@host")
+	r.Part("#chan", "Gone")
+	r.forget(time.Now().Add(time.Minute), map[string]time.Duration{"#chan": time.Hour, "#other": time.Second})
+	if len(r.greeted["#chan"]) != 1 || len(r.greeted["#other"]) != 0 || r.LastSeen("#chan", "Gone").IsZero() {
+		t.Errorf("Expected only welcomes past their cooldown to be forgotten, got %v", r.greeted)
+	}
+	r.forget(time.Now().Add(SEEN_FORGET+time.Minute), nil)
+	if len(r.greeted) != 0 || len(r.seen) != 0 {
+		t.Errorf("Expected everything to be forgotten in time, got %v and %v", r.greeted, r.seen)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(0.5, 2)
+	now := time.Now()
+	if !b.AllowAt(now) || !b.AllowAt(now) || b.AllowAt(now) {
+		t.Errorf("Expected a burst of 2")
+	}
+	if b.AllowAt(now.Add(time.Second)) || !b.AllowAt(now.Add(2*time.Second)) {
+		t.Errorf("Expected a new token after 2 seconds")
+	}
+	if !b.AllowAt(now.Add(time.Hour)) || !b.AllowAt(now.Add(time.Hour)) || b.AllowAt(now.Add(time.Hour)) {
+		t.Errorf("Expected tokens to be capped at the burst")
+	}
+
+	l := NewLimiters(0.5, 1)
+	if !l.Allow("#chan") || l.Allow("#chan") || !l.Allow("#other") {
+		t.Errorf("Expected a bucket for each key")
+	}
+}
+
+func TestVisitorMsg(t *testing.T) {
+	c := newChannel()
+	c.VisitorMsg = "Hi {{.Nick}}, read the rules"
+	if msg := visitorMsg("#chan", c, &WelcomeData{Nick: "Guest"}); msg != "Hi Guest, read the rules" {
+		t.Errorf("Unexpected visitor message: %q", msg)
+	}
+	if !c.AddVisitorExclude(ExcludeMask("ChanServ")) || c.AddVisitorExclude("ChanServ!*@*") {
+		t.Errorf("Expected a nick to be excluded as nick!*@*, once")
+	}
+	c.AddVisitorExclude("*!*@*.bots.example.com")
+	for mask, excluded := range map[string]bool{
+		"ChanServ!ChanServ@services.":     true,
+		"bot1!bot@host1.bots.example.com": true,
+		"Guest!guest@example.com":         false,
+	} {
+		if c.VisitorExcluded(mask) != excluded {
+			t.Errorf("Expected %q excluded: %t", mask, excluded)
+		}
+	}
+	if !c.RemoveVisitorExclude("ChanServ!*@*") || c.VisitorExcluded("ChanServ!ChanServ@services.") {
+		t.Errorf("Expected ChanServ to no longer be excluded")
+	}
+}
+
+func TestJoinFlood(t *testing.T) {
+	f := &FloodLimits{Joins: 3, Window: Duration(time.Minute), Clones: 2, Actions: []string{"+i", FLOOD_BAN, FLOOD_ALERT}}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"+o", "+l", "kick", "i"} {
+		if err := (&FloodLimits{Actions: []string{a}}).Validate(); err == nil {
+			t.Errorf("Expected %q to be an invalid action", a)
+		}
+	}
+
+	defer testOPs(t)()
+	_ops.SaveFile(_opfile)
+
+	// no actions, as the connection is not for real
+	n := &Network{Name: "test", roster: NewRoster(), floods: newFloodState()}
+	c := _ops.Get("#chan")
+	c.Flood = &FloodLimits{Joins: 3, Window: Duration(time.Minute), Clones: 2}
+	join := func(nick, host string) bool {
+		mask := nick + "!user@" + host
+		n.roster.Join("#chan", nick, mask)
+		return n.checkJoinFlood(&ircevent.Event{Nick: nick, Source: mask, Arguments: []string{"#chan"}}, c)
+	}
+	if join("a", "a.example.com") || join("b", "b.example.com") {
+		t.Errorf("Expected no flood from 2 joins")
+	}
+	if !join("c", "c.example.com") || !join("d", "d.example.com") {
+		t.Errorf("Expected a flood from 3 joins, going on after that")
+	}
+
+	n.floods.reset("#chan")
+	if join("e", "e.example.com") {
+		t.Errorf("Expected no flood going on after a reset")
+	}
+	n.floods = newFloodState()
+	c.Flood.Joins = 0
+	if !join("a2", "a.example.com") {
+		t.Errorf("Expected a second nick from a.example.com to be a clone")
+	}
+	n.floods.reset("#chan")
+	if len(n.floods.until) != 0 {
+		t.Errorf("Expected clones to be forgotten after a reset, got %v", n.floods.until)
+	}
+
+	_networks = []*Network{n}
+	n.Conn = ircevent.IRC("opbot", "opbot")
+	now := time.Now()
+	c.Lifts = []*TimedMode{
+		{Mode: "+i", Until: now, Network: "test"},
+		{Mode: "+b", Param: "*!*@a.example.com", Until: now.Add(time.Hour), Network: "test"},
+	}
+	liftModes(now)
+	if len(c.Lifts) != 2 {
+		t.Errorf("Expected modes to be kept while not OP, left: %v", c.Lifts)
+	}
+	other := &Network{Name: "other"}
+	if on := liftOn([]*Network{n, other}, TimedMode{Network: "test"}); len(on) != 1 || on[0] != n {
+		t.Errorf("Expected a mode set on %q to be lifted there only, got %v", n.Name, on)
+	}
+	if on := liftOn([]*Network{n, other}, TimedMode{Network: "renamed"}); len(on) != 2 {
+		t.Errorf("Expected a mode set on a network that's gone to be lifted on all, got %v", on)
+	}
+	c.Lock()
+	c.dropLifted([]TimedMode{*c.Lifts[0], *c.Lifts[1]}, now)
+	c.Unlock()
+	if len(c.Lifts) != 1 || c.Lifts[0].Mode != "+b" {
+		t.Errorf("Expected only the due +i to be dropped once lifted, left: %v", c.Lifts)
+	}
+}
+
+func TestSpam(t *testing.T) {
+	s := &SpamLimits{Lines: 3, Window: Duration(10 * time.Second), Repeats: 1}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&SpamLimits{Lines: 3}).Validate(); err == nil {
+		t.Errorf("Expected lines without window to be invalid")
+	}
+
+	st := newSpamState()
+	now := time.Now()
+	if r := st.check(s, "#chan", "Nick1", "hello", now); r != "" {
+		t.Errorf("Expected no limit passed, got %q", r)
+	}
+	if r := st.check(s, "#chan", "Nick1", "Hello ", now); r != "repeats" {
+		t.Errorf("Expected repeats, got %q", r)
+	}
+	st.check(s, "#chan", "Nick2", "one", now)
+	st.check(s, "#chan", "Nick2", "two", now)
+	st.check(s, "#chan", "Nick2", "three", now)
+	if r := st.check(s, "#chan", "Nick2", "four", now); r != "lines" {
+		t.Errorf("Expected lines, got %q", r)
+	}
+	if r := st.check(s, "#chan", "Nick2", "five", now.Add(time.Minute)); r != "" {
+		t.Errorf("Expected old lines to be forgotten, got %q", r)
+	}
+
+	if st.offend("#chan", "Nick1", "host", now) != 1 || st.offend("#chan", "Other", "host", now) != 2 {
+		t.Errorf("Expected offences to be counted by host")
+	}
+	if st.offend("#chan", "Nick1", "host", now.Add(2*SPAM_FORGET)) != 1 {
+		t.Errorf("Expected old offences to be forgotten")
+	}
+
+	if pct, letters := capsPercent("HELLO there!"); pct != 50 || letters != 10 {
+		t.Errorf("Unexpected caps: %d%% of %d", pct, letters)
+	}
+	members := []Member{{Nick: "Nick1"}, {Nick: "Nick2"}, {Nick: "Nick3"}}
+	if m := mentions("nick1: nick2, Nick3 nick1 hi", members); m != 3 {
+		t.Errorf("Expected 3 mentions, got %d", m)
+	}
+}
+
+func TestCmdLimits(t *testing.T) {
+	n := &Network{climit: NewLimiters(CMD_RATE, CMD_BURST), wlimit: NewLimiters(WHOIS_RATE, WHOIS_BURST)}
+	u := &bot.User{Nick: "Nick1", ID: "host.example.com"}
+	for i := 0; i < WHOIS_BURST; i++ {
+		if ok, _ := n.allowCmd(u, "add"); !ok {
+			t.Fatalf("Expected add #%d to be allowed", i+1)
+		}
+	}
+	if ok, first := n.allowCmd(u, "add"); ok || !first {
+		t.Errorf("Expected add to be limited, and the caller told")
+	}
+	if ok, first := n.allowCmd(u, "add"); ok || first {
+		t.Errorf("Expected add to be limited, silently")
+	}
+	if ok, _ := n.allowCmd(u, "ls"); !ok {
+		t.Errorf("Expected ls to still be allowed")
+	}
+	if ok, _ := n.allowCmd(&bot.User{Nick: "Nick2", ID: "other.example.com"}, "add"); !ok {
+		t.Errorf("Expected other callers not to be limited")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue("test", SendRate{}, nil)
+	q.push(PRIO_LOW, "PRIVMSG #chan :hi")
+	q.push(PRIO_HIGH, "MODE #chan +o Nick1")
+	if line := q.pop(); line != "MODE #chan +o Nick1" {
+		t.Errorf("Expected MODE first, got %q", line)
+	}
+	if line := q.pop(); line != "PRIVMSG #chan :hi" {
+		t.Errorf("Expected PRIVMSG next, got %q", line)
+	}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if d := q.wait("PING x", now); d != 0 {
+			t.Fatalf("Expected line #%d to be sent right away, got a wait of %s", i+1, d)
+		}
+	}
+	if d := q.wait("PING x", now); d != DEF_SEND_PENALTY {
+		t.Errorf("Expected a wait of %s after the burst, got %s", DEF_SEND_PENALTY, d)
+	}
+	if d := q.wait("PING x", now.Add(time.Minute)); d != 0 {
+		t.Errorf("Expected no wait after a pause, got %s", d)
+	}
+	if p := q.penalty(strings.Repeat("x", SENDQ_LINE_BYTES)); p != 2*DEF_SEND_PENALTY {
+		t.Errorf("Expected long lines to cost more, got %s", p)
+	}
+
+	n := &Network{Name: "test", sendq: newSendQueue("test", SendRate{}, nil)}
+	n.Privmsg("#chan", "one\r\n\ntwo\n")
+	n.Notice("Nick1", "\r\n")
+	for _, want := range []string{"PRIVMSG #chan :one", "PRIVMSG #chan :two"} {
+		if line := n.sendq.pop(); line != want {
+			t.Errorf("Expected %q, got %q", want, line)
+		}
+	}
+	if left := n.sendq.queues[PRIO_LOW]; len(left) != 0 {
+		t.Errorf("Expected empty lines to be left out, got %q", left)
+	}
+}
+
+func TestKickBan(t *testing.T) {
+	for _, tc := range []struct {
+		template, hostmask, expected string
+	}{
+		{"*!*@host", "Nick1!~user@dsl-1.example.com", "*!*@dsl-1.example.com"},
+		{"*!ident@*.domain", "Nick1!~user@dsl-1.example.com", "*!~user@*.example.com"},
+		{"*!ident@*.domain", "Nick1!user@example.com", "*!user@example.com"},
+		{"*!*@*.domain", "Nick1!user@10.0.0.1", "*!*@10.0.0.1"},
+		{"nick!*@*", "Nick1!user@host", "Nick1!*@*"},
+		{"*!*@localhost", "Nick1!user@dsl-1.example.com", "*!*@localhost"},
+		{"*!*@*.hostingco.net", "Nick1!user@dsl-1.example.com", "*!*@*.hostingco.net"},
+		{"nickname!identd@*", "Nick1!user@host", "nickname!identd@*"},
+		{"*!*@domain", "Nick1!user@dsl-1.example.com", "*!*@example.com"},
+	} {
+		if mask := BanMask(tc.template, tc.hostmask); mask != tc.expected {
+			t.Errorf("Expected %q from %q, got %q", tc.expected, tc.template, mask)
+		}
+	}
+	if ValidBanMask("host") {
+		t.Errorf("Expected a template without ! and @ to be invalid")
+	}
+
+	defer testOPs(t)()
+	_ops.Get("#chan").Add("Op1", "Op1!op@op.example.com")
+	_ops.SaveFile(_opfile)
+
+	n := &Network{Name: "test", roster: NewRoster()}
+	n.roster.Join("#chan", "Spammer", "Spammer!spam@dsl-1.example.com")
+	n.roster.Join("#chan", "Op1", "Op1!op@op.example.com")
+	by := origin{Caller: "Op1!op@op.example.com", Command: "kb"}
+	_journal.Lock()
+	journalled := len(_journal.sets)
+	_journal.Unlock()
+	if msg, _ := n.kb("#chan", by, "Op1", "Op1", nil); !strings.Contains(msg, "OPs list") {
+		t.Errorf("Expected registered OPs not to be banned, got %q", msg)
+	}
+	msg, err := n.kb("#chan", by, "Op1", "Spammer", []string{"1h", "go", "away"})
+	if err != nil || msg != "OPBot: Banned *!*@dsl-1.example.com from #chan for 1h" {
+		t.Errorf("Unexpected reply %q, error: %v", msg, err)
+	}
+	c := _ops.Get("#chan")
+	if len(c.Lifts) != 1 || c.Lifts[0].Param != "*!*@dsl-1.example.com" || c.Lifts[0].Network != "test" {
+		t.Errorf("Expected a timed ban, got %v", c.Lifts)
+	}
+	_journal.Lock()
+	if len(_journal.sets) != journalled {
+		t.Errorf("Expected timed bans not to be journalled, got %v", _journal.sets[journalled:])
+	}
+	_journal.Unlock()
+	n.kb("#chan", by, "Op1", "Spammer", nil)
+	if len(c.Lifts) != 0 {
+		t.Errorf("Expected a permanent ban to replace the timed one, got %v", c.Lifts)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	for _, tc := range []struct {
+		tokens      []string
+		mode, param string
+	}{
+		{[]string{"CHANMODES=eIbq,k,flj,CFLMPQScgimnprstuz", "PREFIX=(ov)@+"}, "+q", "*!*@host"},
+		{[]string{"PREFIX=(qaohv)~&@%+", "CHANMODES=beI,kLf,l,psmntirzMQNRTOVKDdGPZSCc", "EXTBAN=~,GOSTacjmnpqrt"}, "+b", "~q:*!*@host"},
+		{[]string{"CHANMODES=IXbeg,k,FHJLfjl,ACDKMNOPQRSTUcimnprstz", "EXTBAN=,ACNOQRSTUacjmnprswz"}, "+b", "m:*!*@host"},
+		{[]string{"CHANMODES=beI,k,l,imnpst"}, "", ""},
+	} {
+		is := newISupport()
+		is.parse(tc.tokens)
+		mode, param, ok := is.quiet("*!*@host")
+		if mode != tc.mode || param != tc.param || ok != (tc.mode != "") {
+			t.Errorf("Expected %q %q from %v, got %q %q", tc.mode, tc.param, tc.tokens, mode, param)
+		}
+	}
+
+	defer testOPs(t)()
+	_ops.SaveFile(_opfile)
+
+	n := &Network{Name: "test", roster: NewRoster(), server: newISupport()}
+	n.roster.Join("#chan", "Loud", "Loud!loud@dsl-1.example.com")
+	by := origin{Caller: "Op1!op@op.example.com", Command: "quiet"}
+	if msg, _ := n.quiet("#chan", by, "Loud", "10m"); !strings.Contains(msg, "no way") {
+		t.Errorf("Expected no quiet without ISUPPORT, got %q", msg)
+	}
+	n.server.parse([]string{"CHANMODES=eIbq,k,flj,imnpst"})
+	msg, err := n.quiet("#chan", by, "Loud", "10m")
+	if err != nil || msg != "OPBot: Quieted *!*@dsl-1.example.com in #chan for 10m" {
+		t.Errorf("Unexpected reply %q, error: %v", msg, err)
+	}
+	c := _ops.Get("#chan")
+	if len(c.Lifts) != 1 || c.Lifts[0].Mode != "+q" {
+		t.Errorf("Expected a timed quiet, got %v", c.Lifts)
+	}
+	n.unquiet("#chan", by, "*!*@dsl-1.example.com")
+	if len(c.Lifts) != 0 {
+		t.Errorf("Expected unquiet to drop the timed quiet, got %v", c.Lifts)
+	}
+}
+
+func TestModeLock(t *testing.T) {
+	for _, lock := range []string{"", "nt", "+b", "+k", "+l x", "+nt extra", "+n-n", "+o nick"} {
+		if ValidModeLock(lock) {
+			t.Errorf("Expected %q to be an invalid mode lock", lock)
+		}
+	}
+	ml, err := ParseModeLock("+ntk-is key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ml.String(); s != "+knt-is key" {
+		t.Errorf("Unexpected mode lock %q", s)
+	}
+
+	fix := formatModes(ml.fix(parseModes("+nsk", []string{"other"}, _defModeParams)))
+	if strings.Join(fix, " ") != "-sk+kt other key" {
+		t.Errorf("Unexpected fix %v", fix)
+	}
+	if len(ml.fix(parseModes("+ntk", []string{"key"}, _defModeParams))) != 0 {
+		t.Errorf("Expected nothing to fix")
+	}
+	reverts := formatModes(ml.reverts(parseModes("+i-t+o", []string{"Nick1"}, _defModeParams)))
+	if strings.Join(reverts, " ") != "-i+t" {
+		t.Errorf("Unexpected reverts %v", reverts)
+	}
+
+	defer testOPs(t)()
+	_ops.SaveFile(_opfile)
+
+	n := &Network{Name: "test", roster: NewRoster()}
+	by := origin{Caller: "Op1!op@op.example.com", Command: "modelock"}
+	if msg, _ := n.modeLockCmd("#chan", by, "set", "+v"); !strings.Contains(msg, "Invalid") {
+		t.Errorf("Expected an invalid mode lock to be refused, got %q", msg)
+	}
+	if msg, _ := n.modeLockCmd("#chan", by, "set", "+tn-i"); msg != "OPBot: Mode lock for #chan: +nt-i" {
+		t.Errorf("Unexpected reply %q", msg)
+	}
+	if msg, _ := n.modeLockCmd("#chan", by, "clear", ""); msg != "OPBot: No mode lock for #chan" {
+		t.Errorf("Unexpected reply %q", msg)
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
@@ -17,19 +17,39 @@ import (
 type OPData struct {
 	sync.RWMutex
 	Modified time.Time           `json:"modified"`
-	Channels map[string]*Channel `json:"channels"`
+	Channels map[string]*Channel `json:"channels"` // by channel name, or "namespace/#channel" for network namespaces
+	mtime    time.Time           // modification time of the file when we last loaded or saved it
+	lerr     error               // why the last LoadFile failed, if it did
+	unsaved  bool                // if the last SaveFile failed
 }
 
 type Channel struct {
 	sync.RWMutex
-	WelcomeMsg string              `json:"wmsg"`
-	OPs        map[string][]string `json:"ops"`
+	WelcomeMsg      string               `json:"wmsg"`
+	OPs             map[string][]string  `json:"ops"`
+	Expires         map[string]time.Time `json:"expires,omitempty"`       // nick -> when a temporary OP entry should be removed
+	Schedules       map[string][]*Window `json:"schedules,omitempty"`     // nick -> when the nick should hold OP
+	IdleDeop        Duration             `json:"idle_deop,omitempty"`     // DEOP registered OPs idle longer than this, 0 to disable
+	Voices          map[string][]string  `json:"voices,omitempty"`        // nick -> hostmasks that get voice on join
+	Greetings       map[string]string    `json:"greetings,omitempty"`     // nick -> welcome message of the nick's own choosing
+	WelcomeMode     string               `json:"wmsg_mode,omitempty"`     // how welcome messages are sent, one of the WMODE_* values, "" for the default
+	WelcomeCooldown Duration             `json:"wmsg_cooldown,omitempty"` // don't welcome the same nick again within this, 0 for the default
+	VisitorMsg      string               `json:"vmsg,omitempty"`          // welcome message for those who don't get OP, sent as NOTICE
+	VisitorExclude  []string             `json:"vmsg_exclude,omitempty"`  // hostmasks that never get the visitor welcome message
+	Flood           *FloodLimits         `json:"flood,omitempty"`         // join-flood and clone limits, nil for the default
+	Lifts           []*TimedMode         `json:"lifts,omitempty"`         // modes and bans set by the bot, to be unset later
+	Spam            *SpamLimits          `json:"spam,omitempty"`          // message flood and spam limits, nil for the default
+	BanMask         string               `json:"ban_mask,omitempty"`      // template for masks banned by "!op kb", "" for the default
+	ModeLock        string               `json:"mode_lock,omitempty"`     // modes to keep set and unset, like "+ntk-is key"
 }
 
+// Duration is a time.Duration that is saved as a human readable string, like "336h0m0s"
+type Duration time.Duration
+
 type HostMask struct {
-	Nick     string `json:"nick"`
-	UserID   string `json:"userid"`
-	Host     string `json:"host"`
+	Nick   string `json:"nick"`
+	UserID string `json:"userid"`
+	Host   string `json:"host"`
 	//RealName string `json:"realname"`
 }
 
@@ -38,6 +58,47 @@ type Caller struct {
 	Hostmask string
 }
 
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		// plain number of nanoseconds
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*d = Duration(n)
+		return nil
+	}
+	pd, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(pd)
+	return nil
+}
+
+// UnmarshalText lets config file formats like TOML read a Duration from a string, like "2w" or "90m"
+func (d *Duration) UnmarshalText(b []byte) error {
+	pd, err := parseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(pd)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
 func NewOPData() *OPData {
 	return &OPData{
 		Modified: time.Now(),
@@ -57,14 +118,22 @@ func (o *OPData) LoadFile(filename string) *OPData {
 	file, err := os.Open(filename)
 	if err != nil {
 		log.Errorf("%s: OPData.LoadFile() Error: %q", PLUGIN, err.Error())
+		if !os.IsNotExist(err) {
+			o.lerr = err
+			o.mtime = modTime(filename) // so it's not reloaded until it changes
+		}
 		return o
 	}
 	defer file.Close()
 	err = o.Load(file)
 	if err != nil {
 		log.Error(err)
-		return NewOPData()
+		n := NewOPData()
+		n.lerr = err
+		n.mtime = modTime(filename) // so it's not reloaded until it changes
+		return n
 	}
+	o.mtime = modTime(filename)
 	log.Infof("%s: OPs list (re)loaded from file %q", PLUGIN, filename)
 	return o
 }
@@ -79,35 +148,182 @@ func (o *OPData) Save(w io.Writer) (int, error) {
 	return w.Write(jb)
 }
 
-func (o *OPData) SaveFile(filename string) error {
+// SaveFile writes to a temporary file that is then renamed to filename, so that
+// anyone else reading the file, like the "opbot db" commands, never sees half of it.
+func (o *OPData) SaveFile(filename string) (err error) {
+	defer func(start time.Time) { observeSave(start, err) }(time.Now())
 	o.Lock()
 	defer o.Unlock()
-	file, err := os.Create(filename)
+	defer func() { o.unsaved = err != nil }()
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 	n, err := o.Save(file)
 	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err = os.Chmod(file.Name(), 0644); err != nil {
+		os.Remove(file.Name())
 		return err
 	}
+	if err = os.Rename(file.Name(), filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	o.mtime = modTime(filename)
 	log.Infof("%s: Saved %d bytes to %q", PLUGIN, n, filename)
 	return nil
 }
 
+// Changed tells if filename has been modified by someone else since we last loaded or saved it
+func (o *OPData) Changed(filename string) bool {
+	mt := modTime(filename)
+	o.RLock()
+	defer o.RUnlock()
+	return !mt.IsZero() && !mt.Equal(o.mtime)
+}
+
+// Unsaved tells if the last attempt to save failed, so there are changes that are not on disk
+func (o *OPData) Unsaved() bool {
+	o.RLock()
+	defer o.RUnlock()
+	return o.unsaved
+}
+
+// LoadError returns why the last LoadFile failed, or nil if it went fine. A missing file is not an error.
+func (o *OPData) LoadError() error {
+	o.RLock()
+	defer o.RUnlock()
+	return o.lerr
+}
+
+// Validate checks for things that would make the bot misbehave, or that are most likely mistakes
+func (o *OPData) Validate() []error {
+	errs := make([]error, 0)
+	for _, name := range o.ChannelNames() {
+		if ns, channel := SplitKey(name); !isChannel(channel) || !ValidNamespace(ns) {
+			errs = append(errs, fmt.Errorf("%s: not a valid channel name", name))
+		}
+		c := o.Get(name)
+		c.RLock()
+		if err := ValidateWMsg(c.WelcomeMsg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid welcome message: %s", name, err.Error()))
+		}
+		for nick, masks := range c.OPs {
+			if !ValidNick(nick) {
+				errs = append(errs, fmt.Errorf("%s: %q is not a valid nick", name, nick))
+			}
+			if len(masks) == 0 {
+				errs = append(errs, fmt.Errorf("%s: %q has no hostmasks, and will never get OP", name, nick))
+			}
+			for _, m := range masks {
+				if !ValidMask(m) {
+					errs = append(errs, fmt.Errorf("%s: %q has invalid hostmask %q, expected nick!user@host", name, nick, m))
+				}
+			}
+		}
+		for nick, masks := range c.Voices {
+			for _, m := range masks {
+				if !ValidMask(m) {
+					errs = append(errs, fmt.Errorf("%s: voice %q has invalid hostmask %q, expected nick!user@host", name, nick, m))
+				}
+			}
+		}
+		if c.WelcomeMode != "" && !ValidWMode(c.WelcomeMode) {
+			errs = append(errs, fmt.Errorf("%s: invalid welcome message mode %q", name, c.WelcomeMode))
+		}
+		if err := ValidateWMsg(c.VisitorMsg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid visitor welcome message: %s", name, err.Error()))
+		}
+		for _, m := range c.VisitorExclude {
+			if !ValidMask(m) {
+				errs = append(errs, fmt.Errorf("%s: invalid hostmask %q in visitor exclusion list, expected nick!user@host", name, m))
+			}
+		}
+		if c.Flood != nil {
+			if err := c.Flood.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: flood: %s", name, err.Error()))
+			}
+		}
+		if c.Spam != nil {
+			if err := c.Spam.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: spam: %s", name, err.Error()))
+			}
+		}
+		if c.BanMask != "" && !ValidBanMask(c.BanMask) {
+			errs = append(errs, fmt.Errorf("%s: invalid ban mask template %q, expected nick!user@host", name, c.BanMask))
+		}
+		if c.ModeLock != "" {
+			if _, err := ParseModeLock(c.ModeLock); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid mode lock %q: %s", name, c.ModeLock, err.Error()))
+			}
+		}
+		for nick, msg := range c.Greetings {
+			if _, found := c.OPs[nick]; !found {
+				errs = append(errs, fmt.Errorf("%s: greeting for %q, which is not in the OPs list", name, nick))
+			}
+			if err := ValidateWMsg(msg); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid greeting for %q: %s", name, nick, err.Error()))
+			}
+		}
+		for nick := range c.Expires {
+			if _, found := c.OPs[nick]; !found {
+				errs = append(errs, fmt.Errorf("%s: expiry for %q, which is not in the OPs list", name, nick))
+			}
+		}
+		for nick, windows := range c.Schedules {
+			if _, found := c.OPs[nick]; !found {
+				errs = append(errs, fmt.Errorf("%s: schedule for %q, which is not in the OPs list", name, nick))
+			}
+			for _, w := range windows {
+				if _, err := ParseWindow(w.Days, w.Start+"-"+w.End, w.TZ); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid schedule for %q: %s", name, nick, err.Error()))
+				}
+			}
+		}
+		c.RUnlock()
+	}
+	return errs
+}
+
 func (o *OPData) Get(channel string) *Channel {
 	const fn string = "OPData.Get()"
+	o.Lock()
+	defer o.Unlock()
 	c, found := o.Channels[channel]
 	if !found {
 		devdbg("%s: %s: Creating channel %q with empty oplist", PLUGIN, fn, channel)
-		c = &Channel{
-			OPs: make(map[string][]string),
-		}
+		c = newChannel()
 		o.Channels[channel] = c
 	}
 	return c
 }
 
+func newChannel() *Channel {
+	return &Channel{
+		OPs: make(map[string][]string),
+	}
+}
+
+// ChannelNames returns the sorted names of all channels we have data for
+func (o *OPData) ChannelNames() []string {
+	o.RLock()
+	names := make([]string, 0, len(o.Channels))
+	for k := range o.Channels {
+		names = append(names, k)
+	}
+	o.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
 func (c *Channel) MatchHostMask(nick, mask string) bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -192,9 +408,51 @@ func (c *Channel) RemoveHostmask(nick, mask string) bool {
 func (c *Channel) Remove(nick string) {
 	c.Lock()
 	delete(c.OPs, nick)
+	delete(c.Expires, nick)
+	delete(c.Schedules, nick)
+	delete(c.Greetings, nick)
 	c.Unlock()
 }
 
+// SetExpiry sets when the OP entry for nick should be removed.
+// A zero time makes the entry permanent.
+func (c *Channel) SetExpiry(nick string, t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if t.IsZero() {
+		delete(c.Expires, nick)
+		return
+	}
+	if c.Expires == nil {
+		c.Expires = make(map[string]time.Time)
+	}
+	c.Expires[nick] = t
+}
+
+// Expiry returns when the OP entry for nick expires, and false if the entry is permanent
+func (c *Channel) Expiry(nick string) (time.Time, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	t, found := c.Expires[nick]
+	return t, found
+}
+
+// Expired returns the nicks whose OP entries have expired at the given time
+func (c *Channel) Expired(now time.Time) []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	nicks := make([]string, 0)
+	for nick, t := range c.Expires {
+		if !now.Before(t) {
+			nicks = append(nicks, nick)
+		}
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
 func (c *Channel) Nicks() []string {
 	nicks := make([]string, 0, len(c.OPs))
 	c.RLock()
@@ -229,20 +487,208 @@ func (c *Channel) ClearHostmasks(nick string) bool {
 	return true
 }
 
+// AddWindow adds a time window for when nick should hold OP. Returns false if an identical window exists.
+func (c *Channel) AddWindow(nick string, w *Window) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, existing := range c.Schedules[nick] {
+		if *existing == *w {
+			return false
+		}
+	}
+	if c.Schedules == nil {
+		c.Schedules = make(map[string][]*Window)
+	}
+	c.Schedules[nick] = append(c.Schedules[nick], w)
+	return true
+}
+
+// ClearSchedule removes all time windows for nick, so the nick may hold OP at any time
+func (c *Channel) ClearSchedule(nick string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, found := c.Schedules[nick]; !found {
+		return false
+	}
+	delete(c.Schedules, nick)
+	return true
+}
+
+func (c *Channel) Schedule(nick string) []*Window {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Schedules[nick]
+}
+
+// OnShift tells if nick is allowed to hold OP at the given time
+func (c *Channel) OnShift(nick string, t time.Time) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	windows, found := c.Schedules[nick]
+	if !found || len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Channel) SetIdleDeop(d time.Duration) {
+	c.Lock()
+	c.IdleDeop = Duration(d)
+	c.Unlock()
+}
+
+func (c *Channel) GetIdleDeop() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return time.Duration(c.IdleDeop)
+}
+
+// AddVoice adds a hostmask for nick to get voice on join. Returns false if it's already there.
+func (c *Channel) AddVoice(nick, mask string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, m := range c.Voices[nick] {
+		if m == mask {
+			return false
+		}
+	}
+	if c.Voices == nil {
+		c.Voices = make(map[string][]string)
+	}
+	c.Voices[nick] = append(c.Voices[nick], mask)
+	return true
+}
+
+func (c *Channel) RemoveVoice(nick string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, found := c.Voices[nick]; !found {
+		return false
+	}
+	delete(c.Voices, nick)
+	return true
+}
+
+func (c *Channel) MatchVoice(nick, mask string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, pattern := range c.Voices[nick] {
+		if matchMask(pattern, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Channel) VoiceNicks() []string {
+	c.RLock()
+	nicks := make([]string, 0, len(c.Voices))
+	for k := range c.Voices {
+		nicks = append(nicks, k)
+	}
+	c.RUnlock()
+	sort.Strings(nicks)
+	return nicks
+}
+
+func (c *Channel) VoiceHostmasks(nick string) []string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Voices[nick]
+}
+
 func (c *Channel) Empty() bool {
 	c.RLock()
 	defer c.RUnlock()
 	return len(c.OPs) == 0
 }
 
-func (c *Channel) GetWMsg(nick string) string {
+// SetGreeting sets the welcome message for nick, instead of the one for the channel
+func (c *Channel) SetGreeting(nick, msg string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Greetings == nil {
+		c.Greetings = make(map[string]string)
+	}
+	c.Greetings[nick] = msg
+}
+
+func (c *Channel) RemoveGreeting(nick string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, found := c.Greetings[nick]; !found {
+		return false
+	}
+	delete(c.Greetings, nick)
+	return true
+}
+
+func (c *Channel) Greeting(nick string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Greetings[nick]
+}
+
+// AddVisitorExclude adds a hostmask that should not get the visitor welcome message.
+// Returns false if it's already there.
+func (c *Channel) AddVisitorExclude(mask string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, m := range c.VisitorExclude {
+		if m == mask {
+			return false
+		}
+	}
+	c.VisitorExclude = append(c.VisitorExclude, mask)
+	return true
+}
+
+func (c *Channel) RemoveVisitorExclude(mask string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for i, m := range c.VisitorExclude {
+		if m == mask {
+			c.VisitorExclude = append(c.VisitorExclude[:i], c.VisitorExclude[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// VisitorExcluded tells if mask matches any pattern in the visitor exclusion list
+func (c *Channel) VisitorExcluded(mask string) bool {
 	c.RLock()
 	defer c.RUnlock()
 
-	if nick != "" && strings.Index(c.WelcomeMsg, "%s") > -1 {
-		return fmt.Sprintf(c.WelcomeMsg, nick)
+	for _, pattern := range c.VisitorExclude {
+		if matchMask(pattern, mask) {
+			return true
+		}
 	}
-	return c.WelcomeMsg
+	return false
+}
+
+// GetWMsg renders the channel's welcome message for d, see wmsg.go
+func (c *Channel) GetWMsg(d *WelcomeData) (string, error) {
+	c.RLock()
+	msg := c.WelcomeMsg
+	c.RUnlock()
+	return RenderWMsg(msg, d)
 }
 
 func (h *HostMask) String() string {
@@ -0,0 +1,147 @@
+package opbot
+
+/*
+Policies are defaults for channel settings, for when they're not set in the OPs
+file, e.g. from the config file of the program using the plugin. Settings in the
+OPs file, from "!op wmsg set" and so on, always win.
+*/
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Policy struct {
+	WelcomeMsg      string
+	WelcomeMode     string // one of the WMODE_* values
+	WelcomeCooldown time.Duration
+	VisitorMsg      string
+	Flood           *FloodLimits
+	Spam            *SpamLimits
+	IdleDeop        time.Duration
+	BanMask         string // template for "!op kb", see ban.go
+}
+
+var _policies = struct {
+	sync.RWMutex
+	m map[string]Policy
+}{m: make(map[string]Policy)}
+
+// SetPolicy sets the defaults for channel, or for all channels if channel is "".
+// Values set for a channel win over values set for all channels.
+func SetPolicy(channel string, p Policy) {
+	_policies.Lock()
+	_policies.m[channel] = p
+	_policies.Unlock()
+}
+
+func policy(channel string) Policy {
+	_policies.RLock()
+	defer _policies.RUnlock()
+	p := _policies.m[""]
+	if cp, found := _policies.m[channel]; found {
+		if cp.WelcomeMsg != "" {
+			p.WelcomeMsg = cp.WelcomeMsg
+		}
+		if cp.WelcomeMode != "" {
+			p.WelcomeMode = cp.WelcomeMode
+		}
+		if cp.WelcomeCooldown != 0 {
+			p.WelcomeCooldown = cp.WelcomeCooldown
+		}
+		if cp.VisitorMsg != "" {
+			p.VisitorMsg = cp.VisitorMsg
+		}
+		if cp.Flood != nil {
+			p.Flood = cp.Flood
+		}
+		if cp.Spam != nil {
+			p.Spam = cp.Spam
+		}
+		if cp.IdleDeop != 0 {
+			p.IdleDeop = cp.IdleDeop
+		}
+		if cp.BanMask != "" {
+			p.BanMask = cp.BanMask
+		}
+	}
+	return p
+}
+
+// welcomeMsg gives the welcome message for d.Nick in channel: the nick's own greeting,
+// or the channel's welcome message from the OPs file or the policy
+func welcomeMsg(channel string, c *Channel, d *WelcomeData) string {
+	c.RLock()
+	own := c.WelcomeMsg != ""
+	c.RUnlock()
+
+	var msg string
+	var err error
+	if greeting := c.Greeting(d.Nick); greeting != "" {
+		msg, err = RenderWMsg(greeting, d)
+	} else if own {
+		msg, err = c.GetWMsg(d)
+	} else {
+		msg, err = RenderWMsg(policy(channel).WelcomeMsg, d)
+	}
+	if err != nil {
+		log.Errorf("%s: Unable to render welcome message for %s: %s", PLUGIN, channel, err.Error())
+		return ""
+	}
+	return msg
+}
+
+// visitorMsg gives the welcome message for visitors in channel, from the OPs file or the policy
+func visitorMsg(channel string, c *Channel, d *WelcomeData) string {
+	c.RLock()
+	msg := c.VisitorMsg
+	c.RUnlock()
+	if msg == "" {
+		msg = policy(channel).VisitorMsg
+	}
+	msg, err := RenderWMsg(msg, d)
+	if err != nil {
+		log.Errorf("%s: Unable to render visitor welcome message for %s: %s", PLUGIN, channel, err.Error())
+		return ""
+	}
+	return msg
+}
+
+// welcomeMode gives how welcome messages are sent in channel, from the OPs file or the policy
+func welcomeMode(channel string, c *Channel) string {
+	c.RLock()
+	mode := c.WelcomeMode
+	c.RUnlock()
+	if mode != "" {
+		return mode
+	}
+	if mode = policy(channel).WelcomeMode; mode != "" {
+		return mode
+	}
+	return WMODE_CHANNEL
+}
+
+// welcomeCooldown gives how long to wait before welcoming a nick again in channel,
+// from the OPs file or the policy
+func welcomeCooldown(channel string, c *Channel) time.Duration {
+	c.RLock()
+	d := time.Duration(c.WelcomeCooldown)
+	c.RUnlock()
+	if d != 0 {
+		return d
+	}
+	if d = policy(channel).WelcomeCooldown; d != 0 {
+		return d
+	}
+	return DEF_WMSG_COOLDOWN
+}
+
+// idleTimeout gives the idle DEOP timeout for channel, from the OPs file or the policy
+func idleTimeout(channel string, c *Channel) time.Duration {
+	if d := c.GetIdleDeop(); d != 0 {
+		return d
+	}
+	return policy(channel).IdleDeop
+}
@@ -0,0 +1,358 @@
+package opbot
+
+/*
+Keeps track of who is present in the channels the bot has joined, with their
+hostmask (when known) and whether they have OP. This lets the scheduler act on
+users that are already in a channel, not just when they join. Each network
+has its own roster.
+*/
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+const (
+	SEEN_FORGET time.Duration = 30 * 24 * time.Hour // how long to remember when nicks that left were last seen
+)
+
+type Member struct {
+	Nick       string
+	Mask       string // nick!user@host, empty until we've seen a JOIN or WHO reply for the nick
+	OP         bool
+	LastActive time.Time // last time the nick joined or said something in the channel
+	IdleDeop   bool      // true if the bot took OP because the nick was idle
+}
+
+type Roster struct {
+	sync.RWMutex
+	channels map[string]map[string]*Member
+	seen     map[string]map[string]time.Time // channel -> nick -> when last present, for nicks that left
+	greeted  map[string]map[string]time.Time // channel -> nick -> when last welcomed
+}
+
+func NewRoster() *Roster {
+	return &Roster{
+		channels: make(map[string]map[string]*Member),
+		seen:     make(map[string]map[string]time.Time),
+		greeted:  make(map[string]map[string]time.Time),
+	}
+}
+
+// left remembers when nick left channel. Caller must hold the lock.
+func (r *Roster) left(channel, nick string) {
+	if _, found := r.seen[channel]; !found {
+		r.seen[channel] = make(map[string]time.Time)
+	}
+	r.seen[channel][nick] = time.Now()
+}
+
+// member returns the member for nick in channel, creating both if needed. Caller must hold the lock.
+func (r *Roster) member(channel, nick string) *Member {
+	ch, found := r.channels[channel]
+	if !found {
+		ch = make(map[string]*Member)
+		r.channels[channel] = ch
+	}
+	m, found := ch[nick]
+	if !found {
+		m = &Member{Nick: nick, LastActive: time.Now()}
+		ch[nick] = m
+	}
+	return m
+}
+
+func (r *Roster) Join(channel, nick, mask string) {
+	r.Lock()
+	defer r.Unlock()
+	m := r.member(channel, nick)
+	m.Mask = mask
+	m.OP = false
+	m.LastActive = time.Now()
+	m.IdleDeop = false
+}
+
+// Touch marks nick as active in channel. Returns true if the nick had been
+// deopped for being idle, so the caller can give OP back.
+func (r *Roster) Touch(channel, nick string) bool {
+	r.Lock()
+	defer r.Unlock()
+	m, found := r.channels[channel][nick]
+	if !found {
+		return false
+	}
+	m.LastActive = time.Now()
+	wasIdle := m.IdleDeop
+	m.IdleDeop = false
+	return wasIdle
+}
+
+func (r *Roster) SetIdleDeop(channel, nick string) {
+	r.Lock()
+	defer r.Unlock()
+	if m, found := r.channels[channel][nick]; found {
+		m.IdleDeop = true
+	}
+}
+
+func (r *Roster) Part(channel, nick string) {
+	r.Lock()
+	defer r.Unlock()
+	if _, found := r.channels[channel][nick]; found {
+		r.left(channel, nick)
+	}
+	delete(r.channels[channel], nick)
+}
+
+// Drop forgets who is present in channel, used when the bot itself leaves
+func (r *Roster) Drop(channel string) {
+	r.Lock()
+	defer r.Unlock()
+	for nick := range r.channels[channel] {
+		r.left(channel, nick)
+	}
+	delete(r.channels, channel)
+}
+
+func (r *Roster) Quit(nick string) {
+	r.Lock()
+	defer r.Unlock()
+	for channel, ch := range r.channels {
+		if _, found := ch[nick]; found {
+			r.left(channel, nick)
+		}
+		delete(ch, nick)
+	}
+}
+
+// LastSeen gives when nick was last present in channel, or the zero time if not
+// since the bot joined. For present nicks, it's when they were last active.
+func (r *Roster) LastSeen(channel, nick string) time.Time {
+	r.RLock()
+	defer r.RUnlock()
+	if m, found := r.channels[channel][nick]; found {
+		return m.LastActive
+	}
+	return r.seen[channel][nick]
+}
+
+// Greet tells if nick may be welcomed in channel, that is if it wasn't welcomed
+// there within cooldown. If so, it's remembered as welcomed now.
+func (r *Roster) Greet(channel, nick string, cooldown time.Duration) bool {
+	r.Lock()
+	defer r.Unlock()
+	if t, found := r.greeted[channel][nick]; found && time.Since(t) < cooldown {
+		return false
+	}
+	if _, found := r.greeted[channel]; !found {
+		r.greeted[channel] = make(map[string]time.Time)
+	}
+	r.greeted[channel][nick] = time.Now()
+	return true
+}
+
+// greetedChannels gives the channels where nicks have been welcomed
+func (r *Roster) greetedChannels() []string {
+	r.RLock()
+	defer r.RUnlock()
+	channels := make([]string, 0, len(r.greeted))
+	for channel := range r.greeted {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// forget drops nicks that left more than SEEN_FORGET before now, and welcomes older
+// than the channel's cooldown, as given in cooldowns, so they don't pile up forever
+func (r *Roster) forget(now time.Time, cooldowns map[string]time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	for channel, nicks := range r.seen {
+		for nick, t := range nicks {
+			if now.Sub(t) > SEEN_FORGET {
+				delete(nicks, nick)
+			}
+		}
+		if len(nicks) == 0 {
+			delete(r.seen, channel)
+		}
+	}
+	for channel, nicks := range r.greeted {
+		for nick, t := range nicks {
+			if now.Sub(t) >= cooldowns[channel] {
+				delete(nicks, nick)
+			}
+		}
+		if len(nicks) == 0 {
+			delete(r.greeted, channel)
+		}
+	}
+}
+
+// forgetRoster lets each network drop what its roster remembers that's too old to matter
+func forgetRoster(now time.Time) {
+	for _, n := range _networks {
+		cooldowns := make(map[string]time.Duration)
+		for _, channel := range n.roster.greetedChannels() {
+			cooldowns[channel] = welcomeCooldown(n.key(channel), n.channel(channel))
+		}
+		n.roster.forget(now, cooldowns)
+	}
+}
+
+func (r *Roster) Rename(oldNick, newNick string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, ch := range r.channels {
+		m, found := ch[oldNick]
+		if !found {
+			continue
+		}
+		delete(ch, oldNick)
+		m.Nick = newNick
+		if i := strings.Index(m.Mask, "!"); i > -1 {
+			m.Mask = newNick + m.Mask[i:]
+		}
+		ch[newNick] = m
+	}
+}
+
+func (r *Roster) SetMask(channel, nick, mask string) {
+	r.Lock()
+	defer r.Unlock()
+	r.member(channel, nick).Mask = mask
+}
+
+func (r *Roster) SetOP(channel, nick string, op bool) {
+	r.Lock()
+	defer r.Unlock()
+	if _, found := r.channels[channel][nick]; !found {
+		return
+	}
+	r.channels[channel][nick].OP = op
+}
+
+// Names adds nicks from a NAMES reply, where each nick may be prefixed with its channel status
+func (r *Roster) Names(channel string, names []string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, name := range names {
+		nick := strings.TrimLeft(name, "~&@%+")
+		if nick == "" {
+			continue
+		}
+		r.member(channel, nick).OP = strings.ContainsRune(name[:len(name)-len(nick)], '@')
+	}
+}
+
+// Get returns a copy of the member, or nil if nick is not present in channel.
+// The channel may be named in another case than the server uses, like in a config file.
+func (r *Roster) Get(channel, nick string) *Member {
+	r.RLock()
+	defer r.RUnlock()
+	ch, found := r.channels[channel]
+	if !found {
+		for name := range r.channels {
+			if strings.EqualFold(name, channel) {
+				ch = r.channels[name]
+				break
+			}
+		}
+	}
+	m, found := ch[nick]
+	if !found {
+		return nil
+	}
+	cp := *m
+	return &cp
+}
+
+// Members returns a copy of all known members of channel
+func (r *Roster) Members(channel string) []Member {
+	r.RLock()
+	defer r.RUnlock()
+	members := make([]Member, 0, len(r.channels[channel]))
+	for _, m := range r.channels[channel] {
+		members = append(members, *m)
+	}
+	return members
+}
+
+func addRosterCallbacks(n *Network) {
+	n.Conn.AddCallback("PART", func(e *ircevent.Event) {
+		if e.Nick == n.Conn.GetNick() {
+			n.roster.Drop(e.Arguments[0])
+			return
+		}
+		n.roster.Part(e.Arguments[0], e.Nick)
+	})
+	n.Conn.AddCallback("KICK", func(e *ircevent.Event) {
+		if e.Arguments[1] == n.Conn.GetNick() {
+			n.roster.Drop(e.Arguments[0])
+			return
+		}
+		n.roster.Part(e.Arguments[0], e.Arguments[1])
+	})
+	n.Conn.AddCallback("NOTICE", n.onActivity)
+	n.Conn.AddCallback("CTCP_ACTION", n.onActivity)
+	n.Conn.AddCallback("QUIT", func(e *ircevent.Event) {
+		n.roster.Quit(e.Nick)
+	})
+	n.Conn.AddCallback("NICK", func(e *ircevent.Event) {
+		n.roster.Rename(e.Nick, e.Message())
+	})
+	n.Conn.AddCallback("MODE", func(e *ircevent.Event) {
+		if len(e.Arguments) < 2 {
+			return // user mode, not channel mode
+		}
+		for _, mc := range parseModes(e.Arguments[1], e.Arguments[2:], n.server.modeParams()) {
+			if mc.Mode == 'o' {
+				n.roster.SetOP(e.Arguments[0], mc.Param, mc.Set)
+			}
+		}
+	})
+	// 353 is the NAMES reply: <me> <type> <channel> :<names...>
+	n.Conn.AddCallback("353", func(e *ircevent.Event) {
+		if len(e.Arguments) < 4 {
+			return
+		}
+		n.roster.Names(e.Arguments[2], strings.Fields(e.Arguments[3]))
+	})
+	// 352 is the WHO reply: <me> <channel> <user> <host> <server> <nick> <flags> :<hops> <realname>
+	n.Conn.AddCallback("352", func(e *ircevent.Event) {
+		if len(e.Arguments) < 7 {
+			return
+		}
+		channel, nick := e.Arguments[1], e.Arguments[5]
+		n.roster.SetMask(channel, nick, nick+"!"+e.Arguments[2]+"@"+e.Arguments[3])
+		n.roster.SetOP(channel, nick, strings.ContainsRune(e.Arguments[6], '@'))
+	})
+}
+
+// onActivity updates when a nick was last active in a channel, and gives OP
+// back if it was taken away for being idle. PRIVMSG is handled in onPRIVMSG.
+func (n *Network) onActivity(e *ircevent.Event) {
+	const fn string = "onActivity()"
+
+	if len(e.Arguments) == 0 || !isChannel(e.Arguments[0]) {
+		return
+	}
+	channel := e.Arguments[0]
+	if !n.roster.Touch(channel, e.Nick) {
+		return
+	}
+
+	c := n.channel(channel)
+	if c.MatchHostMask(e.Nick, e.Source) && c.OnShift(e.Nick, time.Now()) {
+		devdbg("%s: %s: %q is back from idling in %s, giving OP", PLUGIN, fn, e.Nick, channel)
+		n.mode(channel, "+o", e.Nick)
+	}
+}
+
+func isChannel(target string) bool {
+	return strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&")
+}
@@ -0,0 +1,188 @@
+package opbot
+
+/*
+Quiets. "!op quiet <nick> [duration]" keeps a nick from talking in the channel
+without kicking it out, and "!op unquiet <nick|mask>" lets it talk again.
+Servers do this in different ways, so the bot goes by what the server says it
+supports (ISUPPORT, numeric 005) when connecting:
+
+- a "q" list mode in CHANMODES, like on Solanum (Libera) and OFTC: +q mask
+- a "q" extban in EXTBAN, like on UnrealIRCd: +b ~q:mask
+- an "m" extban with no prefix, like on InspIRCd: +b m:mask
+
+The mask is made like for "!op kb", and quiets with a duration are lifted the
+same way as timed bans.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+// isupport keeps the ISUPPORT tokens of the server a network is connected to
+type isupport struct {
+	sync.RWMutex
+	tokens map[string]string
+}
+
+func newISupport() *isupport {
+	return &isupport{tokens: make(map[string]string)}
+}
+
+// reset forgets all tokens, e.g. on reconnect, as it might be to another server
+func (is *isupport) reset() {
+	is.Lock()
+	is.tokens = make(map[string]string)
+	is.Unlock()
+}
+
+// parse adds tokens from a 005 reply, like "CHANMODES=beIq,k,l,imnst". "-TOKEN" removes one.
+func (is *isupport) parse(tokens []string) {
+	is.Lock()
+	defer is.Unlock()
+	for _, t := range tokens {
+		if strings.HasPrefix(t, "-") {
+			delete(is.tokens, strings.ToUpper(t[1:]))
+			continue
+		}
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		is.tokens[strings.ToUpper(kv[0])] = kv[1]
+	}
+}
+
+// quiet gives the mode and parameter that quiets mask on this server, or ok false if there's no way to
+func (is *isupport) quiet(mask string) (mode, param string, ok bool) {
+	is.RLock()
+	defer is.RUnlock()
+
+	if chanmodes, found := is.tokens["CHANMODES"]; found {
+		if lists := strings.SplitN(chanmodes, ",", 2)[0]; strings.ContainsRune(lists, 'q') {
+			return "+q", mask, true
+		}
+	}
+	if extban, found := is.tokens["EXTBAN"]; found {
+		if i := strings.Index(extban, ","); i > -1 {
+			prefix, types := extban[:i], extban[i+1:]
+			if strings.ContainsRune(types, 'q') {
+				return "+b", prefix + "q:" + mask, true
+			}
+			if prefix == "" && strings.ContainsRune(types, 'm') {
+				return "+b", "m:" + mask, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// modeParams gives the channel modes that take a parameter, from CHANMODES and PREFIX,
+// or the defaults if the server hasn't told
+func (is *isupport) modeParams() modeParams {
+	if is == nil {
+		return _defModeParams // not set up, like in tests
+	}
+	is.RLock()
+	defer is.RUnlock()
+
+	chanmodes, found := is.tokens["CHANMODES"]
+	types := strings.Split(chanmodes, ",")
+	if !found || len(types) < 3 {
+		return _defModeParams
+	}
+	// lists like b, and modes like k, always take one. Modes like l take one when set.
+	mp := modeParams{always: types[0] + types[1], whenSet: types[2]}
+	prefix, found := is.tokens["PREFIX"]
+	if !found {
+		prefix = "(ov)@+" // what servers have if they don't say
+	}
+	if i := strings.Index(prefix, ")"); strings.HasPrefix(prefix, "(") && i > 0 {
+		mp.always += prefix[1:i]
+	}
+	return mp
+}
+
+func (n *Network) on005(e *ircevent.Event) {
+	if len(e.Arguments) > 2 {
+		n.server.parse(e.Arguments[1 : len(e.Arguments)-1]) // between our nick and "are supported by this server"
+	}
+}
+
+// quiet quiets nick in channel, for the given duration, or until unquieted if it's ""
+func (n *Network) quiet(channel string, by origin, nick, duration string) (string, error) {
+	usage := fmt.Sprintf("%s: Usage: !op %s <nick> [duration]", PLUGIN, strings.ToLower(QUIET))
+	if nick == "" {
+		return usage, nil
+	}
+	var ttl time.Duration
+	if duration != "" {
+		d, err := parseDuration(duration)
+		if err != nil || d <= 0 {
+			return usage, nil
+		}
+		ttl = d
+	}
+	if _, _, ok := n.server.quiet(nick); !ok {
+		return fmt.Sprintf("%s: This server has no way to quiet nicks that I know of", PLUGIN), nil
+	}
+
+	return n.withHostmask(channel, by, nick, "quieting", func(hostmask string) (string, error) {
+		c := n.channel(channel)
+		if c.MatchHostMask(nick, hostmask) {
+			return fmt.Sprintf("%s: %q is in the OPs list, remove them first", PLUGIN, nick), nil
+		}
+		mask := BanMask(banMaskTemplate(n.key(channel), c), hostmask)
+		mode, param, _ := n.server.quiet(mask)
+		log.Infof("%s: %s: Quieting %s (%s) in %s", PLUGIN, n.Name, mask, nick, channel)
+		n.mode(channel, mode, param)
+
+		err := changeLifts(n.key(channel), func(c *Channel) {
+			c.Lock()
+			if ttl > 0 {
+				c.addTimedMode(&TimedMode{Mode: mode, Param: param, Until: time.Now().Add(ttl), Network: n.Name})
+			} else {
+				c.removeTimedMode(mode, param, n.Name) // in case it was timed before
+			}
+			c.Unlock()
+		})
+		if ttl > 0 {
+			return fmt.Sprintf("%s: Quieted %s in %s for %s", PLUGIN, mask, channel, fmtDuration(ttl)), err
+		}
+		return fmt.Sprintf("%s: Quieted %s in %s", PLUGIN, mask, channel), err
+	})
+}
+
+// unquiet lifts a quiet on target in channel, where target is a nick or the mask that was quieted
+func (n *Network) unquiet(channel string, by origin, target string) (string, error) {
+	if target == "" {
+		return fmt.Sprintf("%s: Usage: !op %s <nick|mask>", PLUGIN, strings.ToLower(UNQUIET)), nil
+	}
+	if _, _, ok := n.server.quiet(target); !ok {
+		return fmt.Sprintf("%s: This server has no way to quiet nicks that I know of", PLUGIN), nil
+	}
+
+	lift := func(mask string) (string, error) {
+		mode, param, _ := n.server.quiet(mask)
+		log.Infof("%s: %s: Unquieting %s in %s", PLUGIN, n.Name, mask, channel)
+		n.mode(channel, "-"+strings.TrimPrefix(mode, "+"), param)
+		err := changeLifts(n.key(channel), func(c *Channel) {
+			c.Lock()
+			c.removeTimedMode(mode, param, n.Name)
+			c.Unlock()
+		})
+		return fmt.Sprintf("%s: Unquieted %s in %s", PLUGIN, mask, channel), err
+	}
+
+	if ValidMask(target) {
+		return lift(target)
+	}
+	return n.withHostmask(channel, by, target, "unquieting", func(hostmask string) (string, error) {
+		return lift(BanMask(banMaskTemplate(n.key(channel), n.channel(channel)), hostmask))
+	})
+}
@@ -0,0 +1,139 @@
+package opbot
+
+/*
+Token buckets, for limiting how often the bot does things that others can
+trigger, like sending welcome messages to visitors during a join flood.
+
+A bucket holds up to burst tokens, and gets rate new tokens per second. Each
+action takes a token, and is not allowed when the bucket is empty.
+
+Commands are limited per caller, with one set of buckets for all commands,
+and a stricter one for commands that make the bot send a WHOIS. Callers going
+past the limit are ignored, after being told once.
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CMD_RATE     float64 = 0.5 // commands per second, per caller
+	CMD_BURST    int     = 5
+	WHOIS_RATE   float64 = 0.1 // commands that send a WHOIS, per second, per caller
+	WHOIS_BURST  int     = 2
+	LIMITERS_MAX int     = 1024 // buckets to keep before dropping full ones
+)
+
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time // when tokens was last updated
+	denied bool      // if the last action was not allowed
+}
+
+// Limiters keeps a TokenBucket for each key, like a channel or a nick, created when first needed
+type Limiters struct {
+	sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+}
+
+// NewTokenBucket gives a full bucket, allowing rate actions per second, and up to burst at once
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if there is one, and tells if it did
+func (b *TokenBucket) Allow() bool {
+	return b.AllowAt(time.Now())
+}
+
+// AllowAt is Allow as if it was called at t, for testing
+func (b *TokenBucket) AllowAt(t time.Time) bool {
+	ok, _ := b.take(t)
+	return ok
+}
+
+// take takes a token if there is one at t, and tells if it did, and if this
+// is the first time in a row it didn't
+func (b *TokenBucket) take(t time.Time) (ok bool, first bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if t.After(b.last) {
+		b.tokens += t.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = t
+	}
+	if b.tokens < 1 {
+		first = !b.denied
+		b.denied = true
+		return false, first
+	}
+	b.tokens--
+	b.denied = false
+	return true, false
+}
+
+// full tells if the bucket has all its tokens, as if never used
+func (b *TokenBucket) full(t time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.tokens+t.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+func NewLimiters(rate float64, burst int) *Limiters {
+	return &Limiters{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*TokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket for key, and tells if there was one
+func (l *Limiters) Allow(key string) bool {
+	ok, _ := l.Check(key)
+	return ok
+}
+
+// Check is Allow, but also tells if this is the first time in a row that key is not allowed,
+// e.g. to tell a caller once that they're being ignored
+func (l *Limiters) Check(key string) (ok bool, first bool) {
+	return l.bucket(key).take(time.Now())
+}
+
+func (l *Limiters) bucket(key string) *TokenBucket {
+	l.Lock()
+	defer l.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= LIMITERS_MAX {
+			l.prune()
+		}
+		b = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// prune drops buckets that are full again, as they'd be the same as new ones. Caller must hold the lock.
+func (l *Limiters) prune() {
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package opbot
+
+/*
+Schedules limit when a nick in the OPs list should hold OP, e.g. for
+moderators working in shifts. A nick without any schedule may have OP at
+any time, while a nick with one or more windows only gets OP when at least
+one of them is active.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var _weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring period of time, like "mon-fri 08:00-16:00 Europe/Oslo".
+// If End is before Start, the window runs past midnight into the next day.
+type Window struct {
+	Days  string `json:"days"`  // e.g. "mon-fri" or "sat,sun"
+	Start string `json:"start"` // "15:04"
+	End   string `json:"end"`   // "15:04", or "24:00" for end of day
+	TZ    string `json:"tz,omitempty"`
+}
+
+// ParseWindow validates the given parts and returns a new Window
+func ParseWindow(days, hours, tz string) (*Window, error) {
+	w := &Window{
+		Days: strings.ToLower(days),
+		TZ:   tz,
+	}
+	if _, err := parseDays(w.Days); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid time range %q, expected e.g. 08:00-16:00", hours)
+	}
+	w.Start, w.End = parts[0], parts[1]
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("time range %q is empty", hours)
+	}
+	if _, err := w.location(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Window) String() string {
+	s := fmt.Sprintf("%s %s-%s", w.Days, w.Start, w.End)
+	if w.TZ != "" {
+		s += " " + w.TZ
+	}
+	return s
+}
+
+func (w *Window) location() (*time.Location, error) {
+	if w.TZ == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(w.TZ)
+}
+
+// Active tells if t is within the window. Invalid windows are never active.
+func (w *Window) Active(t time.Time) bool {
+	loc, err := w.location()
+	if err != nil {
+		return false
+	}
+	days, err := parseDays(w.Days)
+	if err != nil {
+		return false
+	}
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return days[t.Weekday()] && now >= start && now < end
+	}
+	// The window runs past midnight, so the early hours belong to the previous day
+	if now >= start {
+		return days[t.Weekday()]
+	}
+	if now < end {
+		return days[(t.Weekday()+6)%7]
+	}
+	return false
+}
+
+// parseDays parses a comma separated list of days or day ranges, like "mon-fri,sun"
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(s, ",") {
+		span := strings.Split(part, "-")
+		if len(span) > 2 {
+			return days, fmt.Errorf("invalid day range %q", part)
+		}
+		first, found := _weekdays[span[0]]
+		if !found {
+			return days, fmt.Errorf("invalid day %q, expected one of mon, tue, wed, thu, fri, sat, sun", span[0])
+		}
+		last := first
+		if len(span) == 2 {
+			last, found = _weekdays[span[1]]
+			if !found {
+				return days, fmt.Errorf("invalid day %q, expected one of mon, tue, wed, thu, fri, sat, sun", span[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock returns the number of minutes since midnight for "15:04"
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected e.g. 08:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
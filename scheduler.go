@@ -0,0 +1,129 @@
+package opbot
+
+/*
+The scheduler wakes up at a fixed interval and takes care of the things that
+should happen at a given time, without anyone giving the bot a command.
+*/
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func startScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			schedule(now)
+		}
+	}()
+}
+
+// _shifts remembers if each scheduled nick was on shift at the previous tick,
+// so we only change modes at window boundaries, and not fight manual OP/DEOP.
+var _shifts = struct {
+	sync.Mutex
+	on map[string]bool // "channel nick" -> on shift
+}{on: make(map[string]bool)}
+
+func schedule(now time.Time) {
+	_changeMu.Lock()
+	reloadIfChanged()
+	_changeMu.Unlock()
+	expireOPs(now)
+	shiftChanges(now)
+	idleDeop(now)
+	liftModes(now)
+	forgetSpam(now)
+	forgetRoster(now)
+}
+
+// expireOPs removes and deops temporary OPs whose time is up
+func expireOPs(now time.Time) {
+	const fn string = "expireOPs()"
+
+	for _, channel := range ops().ChannelNames() {
+		c := ops().Get(channel)
+		for _, nick := range c.Expired(now) {
+			devdbg("%s: %s: Temporary OP for %q in %s has expired", PLUGIN, fn, nick, channel)
+			change(channel, origin{Caller: PLUGIN, Command: "expire " + nick}, func(c *Channel) {
+				c.Remove(nick)
+			})
+			log.Infof("%s: Temporary OP for %q in %s expired, removed from OPs list", PLUGIN, nick, channel)
+			nets, name := networksFor(channel)
+			for _, n := range nets {
+				n.mode(name, "-o", nick) // try to DEOP right away
+			}
+		}
+	}
+}
+
+// shiftChanges gives or takes OP for present users whose schedule window opened or closed since the last tick
+func shiftChanges(now time.Time) {
+	const fn string = "shiftChanges()"
+
+	_shifts.Lock()
+	defer _shifts.Unlock()
+
+	// only nicks that still have a schedule are kept for the next tick
+	shifts := make(map[string]bool)
+	defer func() { _shifts.on = shifts }()
+
+	for _, channel := range ops().ChannelNames() {
+		c := ops().Get(channel)
+		for _, nick := range c.Nicks() {
+			if len(c.Schedule(nick)) == 0 {
+				continue
+			}
+			key := channel + " " + nick
+			on := c.OnShift(nick, now)
+			prev, known := _shifts.on[key]
+			shifts[key] = on
+			if !known || prev == on {
+				continue
+			}
+
+			nets, name := networksFor(channel)
+			for _, n := range nets {
+				m := n.roster.Get(name, nick)
+				if m == nil {
+					continue
+				}
+				if on && !m.OP && c.MatchHostMask(nick, m.Mask) {
+					devdbg("%s: %s: %q in %s on %s is now on shift, giving OP", PLUGIN, fn, nick, name, n.Name)
+					n.mode(name, "+o", nick)
+				} else if !on && m.OP {
+					devdbg("%s: %s: %q in %s on %s is now off shift, taking OP", PLUGIN, fn, nick, name, n.Name)
+					n.mode(name, "-o", nick)
+				}
+			}
+		}
+	}
+}
+
+// idleDeop takes OP from registered OPs that have been idle for longer than the channel allows
+func idleDeop(now time.Time) {
+	for _, channel := range ops().ChannelNames() {
+		c := ops().Get(channel)
+		timeout := idleTimeout(channel, c)
+		if timeout <= 0 {
+			continue
+		}
+		nets, name := networksFor(channel)
+		for _, n := range nets {
+			for _, m := range n.roster.Members(name) {
+				if !m.OP || m.IdleDeop || !c.Has(m.Nick) || m.Nick == n.Conn.GetNick() {
+					continue
+				}
+				if now.Sub(m.LastActive) < timeout {
+					continue
+				}
+				log.Infof("%s: %q has been idle in %s on %s for %s, taking OP", PLUGIN, m.Nick, name, n.Name, fmtDuration(now.Sub(m.LastActive)))
+				n.roster.SetIdleDeop(name, m.Nick)
+				n.mode(name, "-o", m.Nick)
+			}
+		}
+	}
+}
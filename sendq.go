@@ -0,0 +1,203 @@
+package opbot
+
+/*
+Everything the plugin sends to a network goes through a send queue, so that
+it never sends faster than the server allows, and gets disconnected for
+"Excess Flood".
+
+Pacing follows the penalty model from RFC 1459 (section 8.10), that most
+servers use in some form: each line sent moves a timer forward by a penalty,
+starting from now if the timer is behind, and a line is held back until
+sending it leaves the timer no more than a burst window ahead of now. With the defaults, that's 5
+short lines at once, and then one every 2 seconds. Long lines cost more, one
+more penalty for every SENDQ_LINE_BYTES.
+
+MODE and KICK lines go before anything else waiting, so that giving OP or
+stopping a flood isn't held up by chatter.
+*/
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEF_SEND_PENALTY time.Duration = 2 * time.Second
+	DEF_SEND_BURST   time.Duration = 10 * time.Second
+	SENDQ_LINE_BYTES int           = 120
+	SENDQ_MAX        int           = 512 // lines waiting, before chatter is dropped
+)
+
+const (
+	PRIO_HIGH = iota // MODE, KICK
+	PRIO_LOW         // everything else
+)
+
+// SendRate is how fast a network may be sent to, see the top of sendq.go
+type SendRate struct {
+	Penalty time.Duration // added to the timer for each line, 0 for DEF_SEND_PENALTY
+	Burst   time.Duration // how far ahead of now the timer may be, 0 for DEF_SEND_BURST
+}
+
+type sendQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	queues  [2][]string // waiting lines, by priority
+	rate    SendRate
+	timer   time.Time
+	network string
+	send    func(line string)
+}
+
+func newSendQueue(network string, rate SendRate, send func(line string)) *sendQueue {
+	if rate.Penalty <= 0 {
+		rate.Penalty = DEF_SEND_PENALTY
+	}
+	if rate.Burst <= 0 {
+		rate.Burst = DEF_SEND_BURST
+	}
+	q := &sendQueue{
+		rate:    rate,
+		network: network,
+		send:    send,
+	}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// penalty gives how much sending line moves the timer forward
+func (q *sendQueue) penalty(line string) time.Duration {
+	return q.rate.Penalty * time.Duration(1+len(line)/SENDQ_LINE_BYTES)
+}
+
+// push queues line for sending. If the queue is full, chatter is dropped, but MODE and KICK are always queued.
+func (q *sendQueue) push(prio int, line string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if prio == PRIO_LOW && len(q.queues[PRIO_HIGH])+len(q.queues[PRIO_LOW]) >= SENDQ_MAX {
+		log.Warnf("%s: %s: Send queue full, dropping %q", PLUGIN, q.network, line)
+		_mSendDropped.WithLabelValues(q.network).Inc()
+		return
+	}
+	q.queues[prio] = append(q.queues[prio], line)
+	q.depth()
+	q.cond.Signal()
+}
+
+// pop waits for a line to send, and takes it off the queue, highest priority first
+func (q *sendQueue) pop() string {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.queues[PRIO_HIGH]) == 0 && len(q.queues[PRIO_LOW]) == 0 {
+		q.cond.Wait()
+	}
+	prio := PRIO_HIGH
+	if len(q.queues[PRIO_HIGH]) == 0 {
+		prio = PRIO_LOW
+	}
+	line := q.queues[prio][0]
+	q.queues[prio] = q.queues[prio][1:]
+	q.depth()
+	return line
+}
+
+// depth updates the queue depth metric. Caller must hold the lock.
+func (q *sendQueue) depth() {
+	_mSendQueue.WithLabelValues(q.network).Set(float64(len(q.queues[PRIO_HIGH]) + len(q.queues[PRIO_LOW])))
+}
+
+// wait tells how long to wait before sending line at now, and moves the timer forward as if it was sent then
+func (q *sendQueue) wait(line string, now time.Time) time.Duration {
+	if q.timer.Before(now) {
+		q.timer = now
+	}
+	q.timer = q.timer.Add(q.penalty(line))
+	if ahead := q.timer.Sub(now); ahead > q.rate.Burst {
+		return ahead - q.rate.Burst
+	}
+	return 0
+}
+
+// run sends lines as fast as the rate allows, forever
+func (q *sendQueue) run() {
+	for {
+		line := q.pop()
+		if d := q.wait(line, time.Now()); d > 0 {
+			time.Sleep(d)
+		}
+		q.send(line)
+	}
+}
+
+// sendLine sends a line from the send queue, if connected
+func (n *Network) sendLine(line string) {
+	if !n.Conn.Connected() {
+		devdbg("%s: %s: Not connected, dropping %q", PLUGIN, n.Name, line)
+		return
+	}
+	n.Conn.SendRaw(line)
+}
+
+func (n *Network) queue(prio int, line string) {
+	if n.sendq == nil {
+		return // not set up, like in tests
+	}
+	n.sendq.push(prio, line)
+}
+
+// mode sets modes for target, or with no modes, asks the server what they are
+func (n *Network) mode(target string, modes ...string) {
+	n.queue(PRIO_HIGH, strings.Join(append([]string{"MODE", target}, modes...), " "))
+}
+
+func (n *Network) kick(nick, channel, msg string) {
+	n.queue(PRIO_HIGH, "KICK "+channel+" "+nick+" :"+msg)
+}
+
+// textLines splits msg into lines to send, leaving out empty ones, which servers refuse
+func textLines(msg string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(msg, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Privmsg queues a PRIVMSG to target, with one line for each line in msg
+func (n *Network) Privmsg(target, msg string) {
+	for _, line := range textLines(msg) {
+		n.queue(PRIO_LOW, "PRIVMSG "+target+" :"+line)
+	}
+}
+
+// Notice queues a NOTICE to target, with one line for each line in msg
+func (n *Network) Notice(target, msg string) {
+	for _, line := range textLines(msg) {
+		n.queue(PRIO_LOW, "NOTICE "+target+" :"+line)
+	}
+}
+
+// Join queues a JOIN for channel, which may be "#channel key"
+func (n *Network) Join(channel string) {
+	n.queue(PRIO_LOW, "JOIN "+channel)
+}
+
+// Part queues a PART from channel
+func (n *Network) Part(channel string) {
+	n.queue(PRIO_LOW, "PART "+channel)
+}
+
+func (n *Network) whois(nick string) {
+	n.queue(PRIO_LOW, "WHOIS "+nick)
+}
+
+func (n *Network) who(channel string) {
+	n.queue(PRIO_LOW, "WHO "+channel)
+}
@@ -0,0 +1,344 @@
+package opbot
+
+/*
+Message flood and spam protection. Each channel may have limits for:
+
+- lines: messages (PRIVMSG, NOTICE or CTCP) from one nick within a time window
+- repeats: the same line from one nick, within the same window
+- caps: percent of letters in uppercase, for lines with at least SPAM_CAPS_MIN letters
+- mentions: nicks present in the channel highlighted in a single line
+
+When a nick goes past a limit, it's an offence, and the bot does the next of
+the channel's actions: by default first a warning by NOTICE, then a kick, and
+then a timed ban on *!*@host with a kick, for every offence after that.
+Offences are counted by host, so changing nick doesn't start over, and are
+forgotten after SPAM_FORGET without new ones.
+
+Registered OPs, and anyone with OP in the channel, are never checked.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+const (
+	SPAM_WARN     string        = "warn"
+	SPAM_KICK     string        = "kick"
+	SPAM_BAN      string        = "ban"
+	SPAM_CAPS_MIN int           = 10
+	SPAM_FORGET   time.Duration = time.Hour
+	DEF_SPAM_BAN  time.Duration = time.Hour
+)
+
+// DefSpamActions is what the bot does for the first, second, and third and later offences,
+// if the channel doesn't say otherwise
+var DefSpamActions = []string{SPAM_WARN, SPAM_KICK, SPAM_BAN}
+
+// SpamLimits are the message flood and spam limits for a channel, and what to do when they're passed
+type SpamLimits struct {
+	Lines    int      `json:"lines,omitempty"`    // messages allowed within Window from one nick, 0 to not check
+	Window   Duration `json:"window,omitempty"`   // how far back to count messages and repeats
+	Repeats  int      `json:"repeats,omitempty"`  // times the same line may be sent within Window, 0 to not check
+	Caps     int      `json:"caps,omitempty"`     // percent of letters in uppercase, 0 to not check
+	Mentions int      `json:"mentions,omitempty"` // nicks highlighted in one line, 0 to not check
+	Actions  []string `json:"actions,omitempty"`  // for each offence in turn, the last one repeated, nil for DefSpamActions
+	Ban      Duration `json:"ban,omitempty"`      // how long bans last, 0 for DEF_SPAM_BAN
+}
+
+type spamLine struct {
+	at   time.Time
+	text string
+}
+
+type offence struct {
+	count int
+	last  time.Time
+}
+
+// spamState is what each network keeps track of to detect spam
+type spamState struct {
+	sync.Mutex
+	lines    map[string][]spamLine // "channel nick" -> recent messages
+	offences map[string]*offence   // "channel host" -> offences
+}
+
+func newSpamState() *spamState {
+	return &spamState{
+		lines:    make(map[string][]spamLine),
+		offences: make(map[string]*offence),
+	}
+}
+
+// Validate checks that the limits make sense
+func (s *SpamLimits) Validate() error {
+	if s.Lines < 0 || s.Repeats < 0 || s.Mentions < 0 || s.Window < 0 || s.Ban < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if s.Caps < 0 || s.Caps > 100 {
+		return fmt.Errorf("caps is a percentage, from 0 to 100")
+	}
+	if (s.Lines > 0 || s.Repeats > 0) && s.Window == 0 {
+		return fmt.Errorf("lines and repeats need a window")
+	}
+	for _, a := range s.Actions {
+		if a != SPAM_WARN && a != SPAM_KICK && a != SPAM_BAN {
+			return fmt.Errorf("invalid action %q, expected %s, %s or %s", a, SPAM_WARN, SPAM_KICK, SPAM_BAN)
+		}
+	}
+	return nil
+}
+
+func (s *SpamLimits) actions() []string {
+	if len(s.Actions) > 0 {
+		return s.Actions
+	}
+	return DefSpamActions
+}
+
+func (s *SpamLimits) ban() time.Duration {
+	if s.Ban > 0 {
+		return time.Duration(s.Ban)
+	}
+	return DEF_SPAM_BAN
+}
+
+func (s *SpamLimits) off() bool {
+	return s.Lines == 0 && s.Repeats == 0 && s.Caps == 0 && s.Mentions == 0
+}
+
+func (s *SpamLimits) String() string {
+	if s.off() {
+		return "off"
+	}
+	parts := make([]string, 0, 6)
+	if s.Lines > 0 {
+		parts = append(parts, fmt.Sprintf("lines %d/%s", s.Lines, fmtDuration(time.Duration(s.Window))))
+	}
+	if s.Repeats > 0 {
+		parts = append(parts, fmt.Sprintf("repeats %d/%s", s.Repeats, fmtDuration(time.Duration(s.Window))))
+	}
+	if s.Caps > 0 {
+		parts = append(parts, fmt.Sprintf("caps %d%%", s.Caps))
+	}
+	if s.Mentions > 0 {
+		parts = append(parts, fmt.Sprintf("mentions %d", s.Mentions))
+	}
+	parts = append(parts, "actions "+strings.Join(s.actions(), ","), "ban "+fmtDuration(s.ban()))
+	return strings.Join(parts, ", ")
+}
+
+// spamLimits gives the spam limits for channel, from the OPs file or the policy, or nil if there are none
+func spamLimits(channel string, c *Channel) *SpamLimits {
+	c.RLock()
+	s := c.Spam
+	c.RUnlock()
+	if s != nil {
+		return s
+	}
+	return policy(channel).Spam
+}
+
+// capsPercent gives the percentage of letters in text that are uppercase, and the number of letters
+func capsPercent(text string) (int, int) {
+	letters, upper := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters == 0 {
+		return 0, 0
+	}
+	return upper * 100 / letters, letters
+}
+
+// mentions counts the different nicks in members that are highlighted in text
+func mentions(text string, members []Member) int {
+	nicks := make(map[string]bool, len(members))
+	for _, m := range members {
+		nicks[strings.ToLower(m.Nick)] = true
+	}
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		word = strings.TrimRight(word, ":,.!?")
+		if nicks[word] {
+			seen[word] = true
+		}
+	}
+	return len(seen)
+}
+
+// check records a message from nick, and gives what limit it goes past, if any
+func (st *spamState) check(s *SpamLimits, channel, nick, text string, now time.Time) string {
+	st.Lock()
+	defer st.Unlock()
+
+	key := channel + " " + nick
+	lines := append(st.lines[key], spamLine{at: now, text: strings.ToLower(strings.TrimSpace(text))})
+	start := 0
+	for start < len(lines) && now.Sub(lines[start].at) > time.Duration(s.Window) {
+		start++
+	}
+	lines = lines[start:]
+	st.lines[key] = lines
+
+	if s.Lines > 0 && len(lines) > s.Lines {
+		return "lines"
+	}
+	if s.Repeats > 0 {
+		same := 0
+		for _, l := range lines {
+			if l.text == lines[len(lines)-1].text {
+				same++
+			}
+		}
+		if same > s.Repeats {
+			return "repeats"
+		}
+	}
+	return ""
+}
+
+// offend counts an offence by host in channel, and gives the number of offences so far.
+// The nick's recent messages are forgotten, so it's not counted again for the same ones.
+func (st *spamState) offend(channel, nick, host string, now time.Time) int {
+	st.Lock()
+	defer st.Unlock()
+
+	delete(st.lines, channel+" "+nick)
+	key := channel + " " + host
+	o, found := st.offences[key]
+	if !found || now.Sub(o.last) > SPAM_FORGET {
+		o = &offence{}
+		st.offences[key] = o
+	}
+	o.count++
+	o.last = now
+	return o.count
+}
+
+// forget drops offences and messages too old to matter
+func (st *spamState) forget(now time.Time, window time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+
+	for key, o := range st.offences {
+		if now.Sub(o.last) > SPAM_FORGET {
+			delete(st.offences, key)
+		}
+	}
+	for key, lines := range st.lines {
+		if len(lines) == 0 || now.Sub(lines[len(lines)-1].at) > window {
+			delete(st.lines, key)
+		}
+	}
+}
+
+func addSpamCallbacks(n *Network) {
+	for _, code := range []string{
+		"PRIVMSG", "NOTICE", "CTCP", "CTCP_ACTION", "CTCP_VERSION",
+		"CTCP_PING", "CTCP_TIME", "CTCP_USERINFO", "CTCP_CLIENTINFO",
+	} {
+		n.Conn.AddCallback(code, n.checkSpam)
+	}
+}
+
+// checkSpam checks a message to a channel against the channel's spam limits, and acts if it goes past one
+func (n *Network) checkSpam(e *ircevent.Event) {
+	const fn string = "checkSpam()"
+
+	if len(e.Arguments) == 0 || !isChannel(e.Arguments[0]) || e.Nick == n.Conn.GetNick() {
+		return
+	}
+	channel := e.Arguments[0]
+	c := n.channel(channel)
+	s := spamLimits(n.key(channel), c)
+	if s == nil || s.off() {
+		return
+	}
+	if m := n.roster.Get(channel, e.Nick); m != nil && m.OP {
+		return
+	}
+	if c.MatchHostMask(e.Nick, e.Source) {
+		return
+	}
+
+	text := e.Message()
+	reason := n.msgs.check(s, channel, e.Nick, text, time.Now())
+	if reason == "" && s.Caps > 0 {
+		if pct, letters := capsPercent(text); letters >= SPAM_CAPS_MIN && pct >= s.Caps {
+			reason = "caps"
+		}
+	}
+	if reason == "" && s.Mentions > 0 && mentions(text, n.roster.Members(channel)) >= s.Mentions {
+		reason = "mentions"
+	}
+	if reason == "" {
+		return
+	}
+	devdbg("%s: %s: %q in %s went past the %s limit", PLUGIN, fn, e.Nick, channel, reason)
+	n.spamAction(channel, e.Nick, hostOf(e.Source), s, reason)
+}
+
+var _spamReasons = map[string]string{
+	"lines":    "Too many messages",
+	"repeats":  "Repeating yourself",
+	"caps":     "Too many caps",
+	"mentions": "Mass highlighting",
+}
+
+// spamAction does the action for the offence by nick, depending on how many there have been
+func (n *Network) spamAction(channel, nick, host string, s *SpamLimits, reason string) {
+	count := n.msgs.offend(channel, nick, host, time.Now())
+	actions := s.actions()
+	action := actions[len(actions)-1]
+	if count <= len(actions) {
+		action = actions[count-1]
+	}
+	_mSpam.WithLabelValues(reason, action).Inc()
+	msg := _spamReasons[reason]
+	log.Infof("%s: %s: %s from %q in %s, offence #%d: %s", PLUGIN, n.Name, msg, nick, channel, count, action)
+
+	switch action {
+	case SPAM_WARN:
+		n.Notice(nick, fmt.Sprintf("%s: %s in %s. Please stop, or you will be kicked.", PLUGIN, msg, channel))
+	case SPAM_KICK:
+		n.kick(nick, channel, msg)
+	case SPAM_BAN:
+		if host != "" {
+			mask := "*!*@" + host
+			n.mode(channel, "+b", mask)
+			n.timedModes(channel, []*TimedMode{
+				{Mode: "+b", Param: mask, Until: time.Now().Add(s.ban()), Network: n.Name},
+			})
+		}
+		n.kick(nick, channel, fmt.Sprintf("%s, banned for %s", msg, fmtDuration(s.ban())))
+	}
+}
+
+// forgetSpam lets each network drop spam tracking that's too old to matter
+func forgetSpam(now time.Time) {
+	for _, n := range _networks {
+		n.msgs.forget(now, SPAM_FORGET)
+	}
+}
+
+// parseSpamCount parses a number for "!op spam set", with what it's for in the error
+func parseSpamCount(what, s string) (int, error) {
+	i, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid number of %s %q", what, s)
+	}
+	return i, nil
+}
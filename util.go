@@ -2,48 +2,157 @@ package opbot
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/go-chat-bot/bot"
 	glob "github.com/ryanuber/go-glob"
+	log "github.com/sirupsen/logrus"
 )
 
 // Having this as a separate func makes it easier to debug output in dev
 func HelpMsg() string {
 	// Arguments:
-	//	add  <nick>
+	//	add  <nick> [--for <duration>]
+	//	tempop <nick> <duration>
 	//	del  <nick>
 	//	ls   [nick]
-	//	wmsg <get|set> <message>
+	//	wmsg <get|set|mode|cooldown> [message|channel|notice|private|duration]
+	//	greet <get|set|del> [message|nick]
+	//	vmsg <get|set|del|exclude> [message|add|del|ls] [nick|hostmask]
+	//	flood <get|set|off|lift> [joins|clones|actions|lift] [values...]
+	//	spam <get|set|off> [lines|repeats|caps|mentions|actions|ban] [values...]
+	//	idle <get|set> [duration|off]
+	//	kb <nick> [duration] [reason]
+	//	quiet <nick> [duration]
+	//	unquiet <nick|mask>
+	//	banmask <get|set> [template]
+	//	modelock <get|set|clear> [modes [key] [limit]]
 	//  mask <add|del|clear|ls> <nick> [hostmask]
+	//  sched <add|clear|ls> <nick> [days hh:mm-hh:mm [tz]]
 	//  get
+	//  log [n]
+	//  undo [id|ls]
 	//	reload
 	//	clear
 	n := "nick"
 	return fmt.Sprintf(
 		`arguments...
 Where arguments can be one of:
-  %s   <%s>
+  %s   <%s> [%s <duration>]
+  %s <%s> <duration>
   %s   <%s>
   %s    [%s]
-  %s  <%s|%s> <message>
+  %s  <%s|%s|%s|%s> [message|mode|duration]
+  %s <%s|%s|%s> [message|nick]
+  %s  <%s|%s|%s|%s> [message|%s|%s|%s] [nick|hostmask]
+  %s <%s|%s|%s|%s> [joins|clones|actions|lift] [values...]
+  %s  <%s|%s|%s> [lines|repeats|caps|mentions|actions|ban] [values...]
+  %s  <%s|%s> [duration|off]
+  %s    <%s> [duration] [reason]
+  %s <%s> [duration]
+  %s <%s|hostmask>
+  %s <%s|%s> [template]
+  %s <%s|%s|%s> [modes [key] [limit]]
   %s  <%s|%s|%s|%s> <%s> [hostmask]
+  %s <%s|%s|%s> <%s> [days hh:mm-hh:mm [timezone]]
   %s
+  %s [n]
+  %s [id|%s]
   %s
   %s
 `,
-		ADD, n,
+		ADD, n, strings.ToLower(FOR),
+		TEMPOP, n,
 		DEL, n,
 		LS, n,
-		WMSG, GET, SET,
+		WMSG, GET, SET, MODE, COOLDOWN,
+		GREET, GET, SET, DEL,
+		VMSG, GET, SET, DEL, EXCLUDE, ADD, DEL, LS,
+		FLOOD, GET, SET, OFF, LIFT,
+		SPAM, GET, SET, OFF,
+		IDLE, GET, SET,
+		KB, n,
+		QUIET, n,
+		UNQUIET, n,
+		BANMASK, GET, SET,
+		MODELOCK, GET, SET, CLEAR,
 		MASK, ADD, DEL, CLEAR, LS, n,
+		SCHED, ADD, CLEAR, LS, n,
 		GET,
+		LOG,
+		UNDO, LS,
 		RELOAD,
 		CLEAR,
 	)
 }
 
+type modeChange struct {
+	Set   bool
+	Mode  rune
+	Param string
+}
+
+// Channel modes that take a parameter both when set and unset, if the server doesn't
+// say which (see isupport.modeParams). "l" takes one only when set.
+const paramModes string = "ovhbeIkqa"
+
+// modeParams tells which channel modes take a parameter
+type modeParams struct {
+	always  string // both when set and unset, like "b" and "k"
+	whenSet string // only when set, like "l"
+}
+
+var _defModeParams = modeParams{always: paramModes, whenSet: "l"}
+
+// parseModes splits a MODE line, like "+o-v nick1 nick2", into separate changes
+func parseModes(modes string, params []string, mp modeParams) []modeChange {
+	changes := make([]modeChange, 0, len(modes))
+	set := true
+	for _, m := range modes {
+		switch m {
+		case '+':
+			set = true
+		case '-':
+			set = false
+		default:
+			mc := modeChange{Set: set, Mode: m}
+			if strings.ContainsRune(mp.always, m) || (set && strings.ContainsRune(mp.whenSet, m)) {
+				if len(params) > 0 {
+					mc.Param = params[0]
+					params = params[1:]
+				}
+			}
+			changes = append(changes, mc)
+		}
+	}
+	return changes
+}
+
+// ValidNick tells if nick can be in the OPs list. Nicks can't be empty, have spaces,
+// or have characters that would make them look like masks or lists.
+func ValidNick(nick string) bool {
+	return nick != "" && !strings.ContainsAny(nick, " !@*?,")
+}
+
+// ValidMask tells if mask looks like nick!user@host, where any part may contain wildcards
+func ValidMask(mask string) bool {
+	bang := strings.Index(mask, "!")
+	at := strings.LastIndex(mask, "@")
+	return bang > 0 && at > bang+1 && at < len(mask)-1 && !strings.ContainsAny(mask, " ,")
+}
+
+// modTime returns the modification time of filename, or the zero time if it can't be read
+func modTime(filename string) time.Time {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
 func matchMask(pattern, mask string) bool {
 	return glob.Glob(pattern, mask)
 }
@@ -59,13 +168,46 @@ func matchMask(pattern, mask string) bool {
 //	}
 //}
 
+// reload loads the OPs file into a new _ops. Caller must hold _changeMu.
 func reload() {
-	_ops = NewOPData().LoadFile(_opfile)
+	ops := NewOPData().LoadFile(_opfile)
+	_opsMu.Lock()
+	_ops = ops
+	_opsMu.Unlock()
+}
+
+// ops gives the current OPs data. Use it, and not _ops, where _changeMu isn't held.
+func ops() *OPData {
+	_opsMu.RLock()
+	defer _opsMu.RUnlock()
+	return _ops
 }
 
-func clear() {
-	_ops = NewOPData()
+// reloadIfChanged reloads the OPs file if it was changed by someone else, most
+// likely "opbot db", so we pick up the changes before saving over them.
+// Caller must hold _changeMu.
+func reloadIfChanged() {
+	if _ops.Changed(_opfile) {
+		log.Infof("%s: %q was changed on disk, reloading", PLUGIN, _opfile)
+		reload()
+	}
+}
+
+// clear empties all channels, one change set per channel, so it can be undone
+func clear(namespace string, by origin) {
+	for _, channel := range ops().ChannelNames() {
+		if ns, _ := SplitKey(channel); ns != namespace {
+			continue // other networks' channels
+		}
+		change(channel, by, func(c *Channel) {
+			c.Lock()
+			c.replace(newChannel())
+			c.Unlock()
+		})
+	}
+	_changeMu.Lock()
 	err := _ops.SaveFile(_opfile)
+	_changeMu.Unlock()
 	if err != nil {
 		log.Error(err)
 	}
@@ -88,8 +230,8 @@ func safeArgs(num int, args []string) []string {
 	return res
 }
 
-func okCmd(channel, nick, cmd, arg string) bool {
-	c := _ops.Get(channel)
+func (n *Network) okCmd(channel, nick, cmd, arg string) bool {
+	c := n.channel(channel)
 	if c.Empty() {
 		// Need this "hack/hole", otherwise one can't start to fill the list
 		return true
@@ -97,16 +239,16 @@ func okCmd(channel, nick, cmd, arg string) bool {
 	if c.Has(nick) {
 		// compensate for onPRIVMSG not having been run if a bot command is the
 		// first thing to be said in a channel after bot join
-		if _caller.Nick == "" && _caller.Hostmask == "" {
+		if n.caller.Nick == "" && n.caller.Hostmask == "" {
 			return true
 		}
-		// If nick and _caller.Nick are not the same, we are not in sync, and can
+		// If nick and n.caller.Nick are not the same, we are not in sync, and can
 		// not check reliably against hostmask
-		if nick != _caller.Nick {
+		if nick != n.caller.Nick {
 			return true
 		}
 		// At this point it should be ok to check against hostmask
-		if c.MatchHostMask(nick, _caller.Hostmask) {
+		if c.MatchHostMask(nick, n.caller.Hostmask) {
 			return true
 		}
 	}
@@ -114,12 +256,12 @@ func okCmd(channel, nick, cmd, arg string) bool {
 	if match(cmd, LS) {
 		return true
 	}
-	if match(cmd, WMSG) {
+	if match(cmd, WMSG) || match(cmd, IDLE) || match(cmd, GREET) || match(cmd, VMSG) || match(cmd, FLOOD) || match(cmd, SPAM) || match(cmd, BANMASK) || match(cmd, MODELOCK) {
 		if match(arg, "GET") {
 			return true
 		}
 	}
-	if match(cmd, MASK) {
+	if match(cmd, MASK) || match(cmd, SCHED) || match(cmd, UNDO) {
 		if match(arg, LS) {
 			return true
 		}
@@ -127,12 +269,117 @@ func okCmd(channel, nick, cmd, arg string) bool {
 	return false
 }
 
-func readWhois(timeout time.Duration) *HostMask {
+// allowCmd tells if the caller is within the command rate limits, and if not, if
+// it's the first command over the limit, so the caller should be told.
+// Callers are told apart by host, or by nick if the host is not known.
+func (n *Network) allowCmd(u *bot.User, cmd string) (ok bool, first bool) {
+	key := u.ID
+	if key == "" {
+		key = u.Nick
+	}
+	if whoisCmd(cmd) {
+		if ok, first = n.wlimit.Check(key); !ok {
+			return
+		}
+	}
+	return n.climit.Check(key)
+}
+
+// whoisCmd tells if a command makes the bot send a WHOIS
+func whoisCmd(cmd string) bool {
+	switch strings.ToUpper(cmd) {
+	case ADD, TEMPOP, GET, KB, QUIET, UNQUIET:
+		return true
+	}
+	return false
+}
+
+// mutating tells if a command changes the OPs list or channel settings, and should be audited
+func mutating(cmd, arg string) bool {
+	switch strings.ToUpper(cmd) {
+	case ADD, TEMPOP, DEL, KB, QUIET, UNQUIET, RELOAD, CLEAR:
+		return true
+	case MASK, SCHED, UNDO:
+		return !match(arg, LS)
+	case WMSG:
+		return match(arg, SET) || match(arg, MODE) || match(arg, COOLDOWN)
+	case GREET:
+		return match(arg, SET) || match(arg, DEL)
+	case FLOOD:
+		return match(arg, SET) || match(arg, OFF) || match(arg, LIFT)
+	case MODELOCK:
+		return match(arg, SET) || match(arg, CLEAR)
+	case SPAM:
+		return match(arg, SET) || match(arg, OFF)
+	case VMSG:
+		return match(arg, SET) || match(arg, DEL) || match(arg, EXCLUDE)
+	case IDLE, BANMASK:
+		return match(arg, SET)
+	}
+	return false
+}
+
+// callerMask gives the best hostmask we have for the user running a command
+func (n *Network) callerMask(u *bot.User) string {
+	if u.Nick == n.caller.Nick && n.caller.Hostmask != "" {
+		return n.caller.Hostmask
+	}
+	return fmt.Sprintf("%s!*@%s", u.Nick, u.ID)
+}
+
+func (n *Network) readWhois(timeout time.Duration) *HostMask {
 	select {
-	case hm := <-_wchan:
+	case hm := <-n.wchan:
 		return hm
 	case <-time.After(timeout):
+		_mWhoisTimeouts.Inc()
 		return nil
 	}
-	return nil
+}
+
+// parseDuration works like time.ParseDuration, but also accepts a leading
+// number of weeks and/or days, like "2w", "2d" or "1w1d12h", as that's handy
+// for temporary OPs and idle timeouts.
+func parseDuration(s string) (time.Duration, error) {
+	in := s
+	var extra time.Duration
+	for _, u := range []struct {
+		unit byte
+		d    time.Duration
+	}{{'w', 7 * 24 * time.Hour}, {'d', 24 * time.Hour}} {
+		if i := strings.IndexByte(s, u.unit); i > 0 {
+			n, err := strconv.Atoi(s[:i])
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", in)
+			}
+			extra += time.Duration(n) * u.d
+			s = s[i+1:]
+		}
+	}
+	if s == "" && s != in {
+		return extra, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return extra + d, nil
+}
+
+// ParseDuration is parseDuration for other packages, e.g. for reading config files
+func ParseDuration(s string) (time.Duration, error) {
+	return parseDuration(s)
+}
+
+// fmtDuration gives a shorter string than time.Duration.String(), rounded to
+// whole minutes, e.g. "1h59m" instead of "1h59m3.25s"
+func fmtDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	s := strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
 }
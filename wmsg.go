@@ -0,0 +1,126 @@
+package opbot
+
+/*
+Welcome messages are text/template templates, rendered with a WelcomeData for
+the nick that joined, e.g.:
+
+	Welcome back {{.Nick}}, last seen {{ago .LastSeen}} ago. We're {{.Users}} here now.
+
+Messages without "{{" are taken to be in the old format, where every %s is
+replaced by the nick, so messages set before templates keep working.
+
+OPs may set a greeting of their own with "!op greet set", used instead of the
+channel's welcome message. Welcome messages are sent to the channel, or as a
+NOTICE or private message to the nick, and at most once per cooldown period
+for each nick, so that someone stuck in a reconnect loop doesn't flood the
+channel.
+
+Visitors, that is everyone joining who doesn't get OP, may get a welcome
+message of their own, like the channel rules, always as a NOTICE. Visitors
+matching the channel's exclusion list, like services and bots, are left alone.
+As anyone can join, these are also limited per channel, to at most
+VMSG_BURST at once and VMSG_RATE per second after that, so a join flood
+doesn't get the bot kicked off the server for flooding.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	WMODE_CHANNEL     string        = "channel" // PRIVMSG to the channel
+	WMODE_NOTICE      string        = "notice"  // NOTICE to the nick
+	WMODE_PRIVATE     string        = "private" // PRIVMSG to the nick
+	DEF_WMSG_COOLDOWN time.Duration = 10 * time.Minute
+	VMSG_BURST        int           = 5
+	VMSG_RATE         float64       = 0.2
+)
+
+// WelcomeData is what's available to welcome message templates
+type WelcomeData struct {
+	Nick     string
+	User     string // user part of the hostmask
+	Host     string
+	Account  string // services account, if the server tells us (extended-join), or ""
+	Channel  string
+	Users    int       // users in the channel, including the bot
+	LastSeen time.Time // when the nick was last in the channel, zero if not since the bot started
+	Level    string    // "op", "tempop", "voice", or "" for anyone else
+}
+
+var _wmsgFuncs = template.FuncMap{
+	// ago gives how long ago t was, like "2h5m", or "never" for the zero time
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmtDuration(time.Since(t))
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// ValidWMode tells if mode is a way welcome messages can be sent
+func ValidWMode(mode string) bool {
+	switch mode {
+	case WMODE_CHANNEL, WMODE_NOTICE, WMODE_PRIVATE:
+		return true
+	}
+	return false
+}
+
+// ExcludeMask gives the hostmask pattern for an entry in the visitor exclusion list,
+// which may be given as just a nick
+func ExcludeMask(s string) string {
+	if !strings.Contains(s, "!") && !strings.Contains(s, "@") {
+		return s + "!*@*"
+	}
+	return s
+}
+
+func parseWMsg(msg string) (*template.Template, error) {
+	if !strings.Contains(msg, "{{") {
+		msg = strings.Replace(msg, "%s", "{{.Nick}}", -1)
+	}
+	return template.New("wmsg").Funcs(_wmsgFuncs).Parse(msg)
+}
+
+// RenderWMsg renders the welcome message template msg with d. The result is
+// always a single line, as it's sent as one message.
+func RenderWMsg(msg string, d *WelcomeData) (string, error) {
+	if msg == "" {
+		return "", nil
+	}
+	tmpl, err := parseWMsg(msg)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// ValidateWMsg checks that msg is a template that can be rendered, both for
+// nicks seen before and not. Errors are shortened for showing on IRC, leaving
+// out the template name and position.
+func ValidateWMsg(msg string) error {
+	for _, d := range []*WelcomeData{
+		{Nick: "Nick", User: "user", Host: "host", Channel: "#channel", Users: 2, Level: "op"},
+		{Nick: "Nick", User: "user", Host: "host", Account: "account", Channel: "#channel", Users: 2, LastSeen: time.Now(), Level: "voice"},
+	} {
+		if _, err := RenderWMsg(msg, d); err != nil {
+			emsg := err.Error()
+			if i := strings.LastIndex(emsg, ": "); i > -1 {
+				emsg = emsg[i+2:]
+			}
+			return errors.New(emsg)
+		}
+	}
+	return nil
+}